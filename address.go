@@ -1,5 +1,5 @@
 // address.go - contains methods for FileBuffer for line address resolution
-package main
+package ged
 
 import (
 	"fmt"
@@ -131,7 +131,7 @@ func (f *FileBuffer) ResolveAddr(cmd string) (line, cmdOffset int, e error) {
 		}
 	case rxMark.MatchString(m):
 		c := m[1] // len should already be verified by regexp
-		line, e = buffer.GetMark(c)
+		line, e = f.GetMark(c)
 	case rxRE.MatchString(m):
 		r := rxRE.FindAllStringSubmatch(m, -1)
 		// 0: full
@@ -148,12 +148,16 @@ func (f *FileBuffer) ResolveAddr(cmd string) (line, cmdOffset int, e error) {
 			restr = r[0][3]
 		}
 		var re *regexp.Regexp
-		if re, e = regexp.Compile(restr); e != nil {
-			e = fmt.Errorf("invalid regexp: %v", e)
+		if re, e = f.re.compile(restr); e != nil {
 			return
 		}
+		// the search starts with the next (or previous) line, and wraps around to the current line
 		var c int
-		for i := 0; i < f.Len(); i++ {
+		for i := 1; i <= f.Len(); i++ {
+			if f.Interrupted() {
+				e = ErrInterrupt
+				return
+			}
 			c = (sign*i + f.GetAddr() + f.Len()) % f.Len()
 			if re.MatchString(f.GetMust(c, false)) {
 				line = c
@@ -277,12 +281,12 @@ func (f *FileBuffer) AddrRange(addrs []int) (r [2]int, e error) {
 func (f *FileBuffer) AddrRangeOrLine(addrs []int) (r [2]int, e error) {
 	if len(addrs) > 1 {
 		// delete a range
-		if r, e = buffer.AddrRange(addrs); e != nil {
+		if r, e = f.AddrRange(addrs); e != nil {
 			return
 		}
 	} else {
 		// delete a line
-		if r[0], e = buffer.AddrValue(addrs); e != nil {
+		if r[0], e = f.AddrValue(addrs); e != nil {
 			return
 		}
 		r[1] = r[0]
@@ -0,0 +1,190 @@
+// buffers.go - implements editing more than one buffer at once
+package ged
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+)
+
+// An openBuffer is a buffer the editor has open, and the file it's editing.
+// The current buffer's state lives in the Editor while it's current, and is only stashed here when we switch away from it.
+type openBuffer struct {
+	id       int
+	buffer   *FileBuffer
+	fileName string
+	swap     *os.File
+	saved    *checkpoint // unsaved changes as of the last command, for Hangup
+}
+
+// rxBufferDest matches a destination in another buffer for t and m (buffer:address)
+var rxBufferDest = regexp.MustCompile(`^\s*([0-9]+):`)
+
+// stash saves the current buffer's state in the buffer list
+func (ed *Editor) stash() {
+	ed.mu.Lock()
+	ed.cur.buffer, ed.cur.fileName, ed.cur.swap, ed.cur.saved = ed.buffer, ed.fileName, ed.swap, ed.saved
+	ed.mu.Unlock()
+}
+
+// switchTo makes b the current buffer
+func (ed *Editor) switchTo(b *openBuffer) {
+	ed.stash()
+	ed.mu.Lock()
+	ed.cur = b
+	ed.buffer, ed.fileName, ed.swap, ed.saved = b.buffer, b.fileName, b.swap, b.saved
+	ed.mu.Unlock()
+	ed.buffer.SetHistory(ed.History)
+	ed.buffer.SetInterrupt(ed.done)
+	ed.buffer.re = ed.re
+}
+
+// findBuffer finds a buffer by its number
+func (ed *Editor) findBuffer(id string) (b *openBuffer, e error) {
+	n, e := strconv.Atoi(id)
+	if e != nil {
+		return nil, fmt.Errorf("invalid buffer: %s", id)
+	}
+	for _, b = range ed.buffers {
+		if b.id == n {
+			return b, nil
+		}
+	}
+	return nil, fmt.Errorf("no such buffer: %d", n)
+}
+
+// openFile opens a file in a new buffer and makes it current, or makes the buffer it's already open in current
+func (ed *Editor) openFile(file string) (e error) {
+	ed.stash()
+	for _, b := range ed.buffers {
+		if len(b.fileName) > 0 && filepath.Clean(b.fileName) == filepath.Clean(file) {
+			ed.switchTo(b)
+			return
+		}
+	}
+	prev := ed.cur
+	b := &openBuffer{
+		id:     ed.buffers[len(ed.buffers)-1].id + 1,
+		buffer: NewFileBuffer(nil),
+	}
+	ed.mu.Lock()
+	ed.buffers = append(ed.buffers, b)
+	ed.mu.Unlock()
+	ed.switchTo(b)
+	if e = ed.Load(file); e != nil {
+		ed.switchTo(prev)
+		ed.closeBuffer(b)
+	}
+	return
+}
+
+// closeBuffer closes a buffer, unsaved changes and all.  If it's the current buffer, the next one becomes current.
+func (ed *Editor) closeBuffer(b *openBuffer) {
+	i := 0
+	for ed.buffers[i] != b {
+		i++
+	}
+	if b == ed.cur {
+		ed.switchTo(ed.buffers[(i+1)%len(ed.buffers)])
+	}
+	removeSwap(b.buffer, b.swap)
+	ed.mu.Lock()
+	ed.buffers = append(ed.buffers[:i:i], ed.buffers[i+1:]...)
+	ed.mu.Unlock()
+}
+
+// dirtyBuffer finds a buffer with unsaved changes, the current one first
+func (ed *Editor) dirtyBuffer() *openBuffer {
+	if ed.buffer.Dirty() {
+		return ed.cur
+	}
+	for _, b := range ed.buffers {
+		if b != ed.cur && b.buffer.Dirty() {
+			return b
+		}
+	}
+	return nil
+}
+
+// copyTo copies (t) or moves (m) lines to another buffer, as a transaction of its own in that buffer
+func (ed *Editor) copyTo(cmd byte, r [2]int, to *openBuffer, line int) (e error) {
+	var lines []string
+	if lines, e = ed.buffer.Get(r); e != nil {
+		return
+	}
+	to.buffer.Start()
+	e = to.buffer.Insert(line, lines)
+	to.buffer.End()
+	ed.mu.Lock()
+	to.saved = to.buffer.checkpoint()
+	ed.mu.Unlock()
+	if e != nil || cmd != 'm' {
+		return
+	}
+	return ed.buffer.Delete(r)
+}
+
+// cmdBuffers lists the open buffers (B), or opens a file in a new buffer (B file)
+func (ed *Editor) cmdBuffers(ctx *Context) (e error) {
+	file := ctx.cmd[ctx.cmdOffset+1:]
+	file = file[wsOffset(file):]
+	if len(file) > 0 {
+		if e = ed.restrictFile(file); e != nil {
+			return
+		}
+		return ed.openFile(file)
+	}
+	ed.stash()
+	for _, b := range ed.buffers {
+		cur := " "
+		if b == ed.cur {
+			cur = "*"
+		}
+		dirty := "-"
+		if b.buffer.Dirty() {
+			dirty = "+"
+		}
+		fmt.Fprintf(ed.out, "%s%d\t%s\t%d\t%s\n", cur, b.id, dirty, b.buffer.Len(), b.fileName)
+	}
+	return
+}
+
+// cmdBuffer switches to buffer n (b n), or to the next buffer (b).
+// bq closes the current buffer, or buffer n (bq n), warning if it has unsaved changes, and bQ closes it anyway.
+func (ed *Editor) cmdBuffer(ctx *Context) (e error) {
+	arg := ctx.cmd[ctx.cmdOffset+1:]
+	quit := byte(0)
+	if len(arg) > 0 && (arg[0] == 'q' || arg[0] == 'Q') {
+		quit = arg[0]
+		arg = arg[1:]
+	}
+	arg = arg[wsOffset(arg):]
+	b := ed.cur
+	if len(arg) > 0 {
+		if b, e = ed.findBuffer(arg); e != nil {
+			return
+		}
+	} else if quit == 0 {
+		for i := range ed.buffers {
+			if ed.buffers[i] == ed.cur {
+				b = ed.buffers[(i+1)%len(ed.buffers)]
+				break
+			}
+		}
+	}
+	if quit == 0 {
+		ed.switchTo(b)
+		return
+	}
+	ed.stash()
+	if quit == 'q' && b.buffer.Dirty() {
+		return fmt.Errorf("warning: file modified")
+	}
+	if len(ed.buffers) == 1 {
+		return fmt.Errorf("cannot close the only buffer")
+	}
+	ed.closeBuffer(b)
+	return
+}
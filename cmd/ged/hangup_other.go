@@ -0,0 +1,12 @@
+//go:build !plan9
+// +build !plan9
+
+// hangup_other.go - the signals that mean we've been hung up on
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+var hangupSignals = []os.Signal{syscall.SIGHUP, syscall.SIGTERM}
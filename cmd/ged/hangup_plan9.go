@@ -0,0 +1,9 @@
+// hangup_plan9.go - the notes that mean we've been hung up on
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+var hangupSignals = []os.Signal{syscall.Note("hangup")}
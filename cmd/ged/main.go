@@ -0,0 +1,135 @@
+// main.go - main entry point for ged
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+
+	"github.com/jlowellwofford/ged"
+)
+
+// flags
+var (
+	fSuppress = flag.Bool("s", false, "suppress counts")
+	fPrompt   = flag.String("p", "*", "specify a command prompt")
+	fLoose    = flag.Bool("l", false, "loose exit mode, don't return errors for command failure")
+	fRestrict = flag.Bool("r", false, "no editing outside directory, no command exec")
+	fHistory  = flag.Int("u", 0, "maximum depth of the undo history (0 is unlimited)")
+	fBackup   = flag.Bool("b", false, "keep a backup (file~) when writing a file")
+	fExtended = flag.Bool("E", false, "use extended regular expressions")
+	fSwap     = flag.Bool("S", false, "keep a swap journal (.file.ged-swap) to recover from crashes")
+	fRecover  = flag.Bool("R", false, "recover file from its swap journal (implies -S)")
+	fNoEdit   = flag.Bool("L", false, "don't edit commands as they're typed, read the terminal as it is")
+	fTimeout  = flag.Duration("T", 0, "kill shell commands that run for longer than this (0 is no limit)")
+	fOutput   = flag.Int64("O", 0, "maximum bytes of shell command output to read into the buffer (0 is no limit)")
+	fStderr   = flag.Bool("capture-stderr", false, "read shell commands' errors into the buffer along with their output")
+)
+
+// Entry point
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-s] [-p <prompt>] [file]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	ed := ged.NewEditor(os.Stdin, os.Stdout)
+	ed.Suppress = *fSuppress
+	ed.Prompt = *fPrompt
+	ed.Loose = *fLoose
+	ed.Restrict = *fRestrict
+	ed.History = *fHistory
+	ed.Backup = *fBackup
+	ed.Swap = *fSwap || *fRecover
+	ed.Extended = *fExtended
+	ed.ShellStdin = os.Stdin
+	ed.Stderr = os.Stderr
+	ed.ShellTimeout = *fTimeout
+	ed.ShellMaxOutput = *fOutput
+	ed.ShellStderr = *fStderr
+	// on a terminal, commands can be edited as they're typed, and recalled from the history
+	var term *ged.Terminal
+	if !*fNoEdit {
+		history := ""
+		if home, err := os.UserHomeDir(); err == nil {
+			history = filepath.Join(home, ".ged_history")
+		}
+		if t, err := ged.NewTerminal(os.Stdin, os.Stdout, history); err == nil {
+			term = t
+			ed.SetTerminal(term)
+		}
+	}
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "p" {
+			ed.ShowPrompt = true
+		}
+	})
+	args := flag.Args()
+	if len(args) > 1 { // we only accept one additional argument
+		flag.Usage()
+		os.Exit(ged.ExitError)
+	}
+	if *fRecover && len(args) == 0 {
+		flag.Usage()
+		os.Exit(ged.ExitError)
+	}
+	// if we're hung up on or killed, save what we can
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, hangupSignals...)
+	go func() {
+		<-sig
+		if term != nil {
+			term.Restore()
+		}
+		if e := ed.Hangup(); e != nil {
+			fmt.Fprintf(os.Stderr, "could not write ed.hup: %v\n", e)
+		}
+		os.Exit(ged.ExitError)
+	}()
+	// ^C interrupts the command that's running, not ged
+	intr := make(chan os.Signal, 1)
+	signal.Notify(intr, os.Interrupt)
+	go func() {
+		for range intr {
+			ed.Interrupt()
+		}
+	}()
+	// z and l need to know how big the terminal is
+	if lines, cols, ok := ged.WindowSize(os.Stdout); ok {
+		ed.SetWindowSize(lines, cols)
+	}
+	if len(resizeSignals) > 0 {
+		winch := make(chan os.Signal, 1)
+		signal.Notify(winch, resizeSignals...)
+		go func() {
+			for range winch {
+				if lines, cols, ok := ged.WindowSize(os.Stdout); ok {
+					ed.SetWindowSize(lines, cols)
+				}
+			}
+		}()
+	}
+	if len(args) == 1 { // we were given a file name
+		load := ed.Load
+		if *fRecover {
+			load = ed.Recover
+		}
+		if e := load(args[0]); e != nil {
+			fmt.Fprintln(os.Stderr, e)
+			os.Exit(ged.ExitError)
+		}
+	}
+	status, e := ed.Run()
+	if e != nil {
+		fmt.Fprintf(os.Stderr, "error reading stdin: %v", e)
+	}
+	ed.Close()
+	if term != nil {
+		if e := term.Close(); e != nil {
+			fmt.Fprintln(os.Stderr, e)
+		}
+	}
+	os.Exit(status)
+}
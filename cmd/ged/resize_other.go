@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+// resize_other.go - we can't tell when the terminal is resized
+package main
+
+import "os"
+
+var resizeSignals = []os.Signal{}
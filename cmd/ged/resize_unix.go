@@ -0,0 +1,12 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+// resize_unix.go - the signals that mean the terminal was resized
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+var resizeSignals = []os.Signal{syscall.SIGWINCH}
@@ -1,8 +1,7 @@
 // commands.go - defines editor commands
-package main
+package ged
 
 import (
-	"bufio"
 	"bytes"
 	"fmt"
 	"io"
@@ -10,144 +9,192 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // A Context is passed to an invoked command
 type Context struct {
-	cmd       string // full command string
-	cmdOffset int    // start of the command after address resolution
-	addrs     []int  // resolved addresses
+	cmd       string    // full command string
+	cmdOffset int       // start of the command after address resolution
+	addrs     []int     // resolved addresses
+	addressed bool      // was an address given? (addrs always has the current line if not)
+	print     printMode // print the current line afterwards, set by a print suffix
+	reg       byte      // the register to cut to or paste from, 0 for the unnamed one (see registers)
 }
 
 // A Command can be run with a Context and returns an error
-type Command func(*Context) error
+type Command func(*Editor, *Context) error
+
+// ErrRestrictShell is returned when a shell command is used in restricted mode
+var ErrRestrictShell = fmt.Errorf("restricted mode: shell commands are not allowed")
+
+// ErrRestrictFile is returned when a file outside of the current directory is used in restricted mode
+var ErrRestrictFile = fmt.Errorf("restricted mode: file names may not contain a path")
+
+// restrictFile checks that a file name is allowed in restricted mode
+func (ed *Editor) restrictFile(file string) error {
+	if ed.Restrict && (strings.ContainsAny(file, "/"+string(os.PathSeparator)) || strings.Contains(file, "..")) {
+		return ErrRestrictFile
+	}
+	return nil
+}
 
 // The cmds map maps single byte commands to their handler functions.
 // This is also a good way to check what commands are implemented.
 var cmds = map[byte]Command{
-	'q': cmdQuit,
-	'Q': cmdQuit,
-	'd': cmdDelete,
-	'l': cmdPrint,
-	'p': cmdPrint,
-	'n': cmdPrint,
-	'h': cmdErr,
-	'H': cmdErr,
-	'a': cmdInput,
-	'i': cmdInput,
-	'c': cmdInput,
-	'w': cmdWrite,
-	'W': cmdWrite,
-	'k': cmdMark,
-	'e': cmdEdit,
-	'E': cmdEdit,
-	'r': cmdEdit,
-	'f': cmdFile,
-	'=': cmdLine,
-	'j': cmdJoin,
-	'm': cmdMove,
-	't': cmdMove,
-	'y': cmdCopy,
-	'x': cmdPaste,
-	'P': cmdPrompt,
-	's': cmdSub,
-	'u': cmdUndo,
-	'D': cmdDump, // var dump the buffer for debug
-	'z': cmdScroll,
-	'!': cmdCommand,
-	'#': func(*Context) (e error) { return },
+	'q': (*Editor).cmdQuit,
+	'Q': (*Editor).cmdQuit,
+	'd': (*Editor).cmdDelete,
+	'l': (*Editor).cmdPrint,
+	'p': (*Editor).cmdPrint,
+	'n': (*Editor).cmdPrint,
+	'h': (*Editor).cmdErr,
+	'H': (*Editor).cmdErr,
+	'a': (*Editor).cmdInput,
+	'i': (*Editor).cmdInput,
+	'c': (*Editor).cmdInput,
+	'w': (*Editor).cmdWrite,
+	'W': (*Editor).cmdWrite,
+	'k': (*Editor).cmdMark,
+	'e': (*Editor).cmdEdit,
+	'E': (*Editor).cmdEdit,
+	'r': (*Editor).cmdEdit,
+	'f': (*Editor).cmdFile,
+	'=': (*Editor).cmdLine,
+	'j': (*Editor).cmdJoin,
+	'm': (*Editor).cmdMove,
+	't': (*Editor).cmdMove,
+	'y': (*Editor).cmdCopy,
+	'x': (*Editor).cmdPaste,
+	'P': (*Editor).cmdPrompt,
+	's': (*Editor).cmdSub,
+	'u': (*Editor).cmdUndo,
+	'U': (*Editor).cmdUndo,
+	'T': (*Editor).cmdUndoTree,
+	'N': (*Editor).cmdLineEnding,
+	'C': (*Editor).cmdCompare,
+	'R': (*Editor).cmdRegisters,
+	'B': (*Editor).cmdBuffers,
+	'b': (*Editor).cmdBuffer,
+	'D': (*Editor).cmdDump, // var dump the buffer for debug
+	'z': (*Editor).cmdScroll,
+	'!': (*Editor).cmdCommand,
+	'#': func(*Editor, *Context) (e error) { return },
+}
+
+// The global commands run other commands, so they must be added after cmds is initialized.
+func init() {
+	cmds['g'] = (*Editor).cmdGlobal
+	cmds['G'] = (*Editor).cmdGlobal
+	cmds['v'] = (*Editor).cmdGlobal
+	cmds['V'] = (*Editor).cmdGlobal
 }
 
 //////////////////////
 // Command handlers /
 ////////////////////
 
-func cmdDelete(ctx *Context) (e error) {
+func (ed *Editor) cmdDelete(ctx *Context) (e error) {
 	var r [2]int
-	if r, e = buffer.AddrRangeOrLine(ctx.addrs); e != nil {
+	if r, e = ed.buffer.AddrRangeOrLine(ctx.addrs); e != nil {
 		return
 	}
-	e = buffer.Delete(r)
-	return
+	var lines []string
+	if lines, e = ed.buffer.Get(r); e != nil {
+		return
+	}
+	if e = ed.buffer.Delete(r); e != nil {
+		return
+	}
+	return ed.regs.put(ctx.reg, lines, true)
 }
 
-func cmdQuit(ctx *Context) (e error) {
-	if ctx.cmd[ctx.cmdOffset] == 'q' && buffer.Dirty() {
+func (ed *Editor) cmdQuit(ctx *Context) (e error) {
+	if ctx.cmd[ctx.cmdOffset] != 'q' {
+		return ErrQuit
+	}
+	ed.stash()
+	if b := ed.dirtyBuffer(); b == ed.cur {
 		return fmt.Errorf("warning: file modified")
+	} else if b != nil {
+		return fmt.Errorf("warning: buffer %d modified", b.id)
 	}
-	os.Exit(0)
-	return
+	return ErrQuit
 }
 
-func cmdPrint(ctx *Context) (e error) {
+func (ed *Editor) cmdPrint(ctx *Context) (e error) {
 	var r [2]int
-	if r, e = buffer.AddrRangeOrLine(ctx.addrs); e != nil {
+	if r, e = ed.buffer.AddrRangeOrLine(ctx.addrs); e != nil {
 		return
 	}
+	m, _ := parseSuffix(ctx.cmd[ctx.cmdOffset : ctx.cmdOffset+1])
+	m |= ctx.print
+	ctx.print = 0 // we print every line, not just the last
 	for l := r[0]; l <= r[1]; l++ {
-		if ctx.cmd[ctx.cmdOffset] == 'n' {
-			fmt.Printf("%d\t", l+1)
+		if ed.buffer.Interrupted() {
+			return ErrInterrupt
 		}
-		line := buffer.GetMust(l, true)
-		if ctx.cmd[ctx.cmdOffset] == 'l' {
-			line += "$" // TODO: the man pages describes more escaping, but it's not clear what GNU ed actually does.
+		if e = ed.printLine(l, m); e != nil {
+			return
 		}
-		fmt.Printf("%s\n", line)
 	}
 	return
 }
 
-func cmdScroll(ctx *Context) (e error) {
-	start, e := buffer.AddrValue(ctx.addrs)
+func (ed *Editor) cmdScroll(ctx *Context) (e error) {
+	start, e := ed.buffer.AddrValue(ctx.addrs)
 	if e != nil {
 		return
 	}
-	// parse win size (if there)
-	winStr := ctx.cmd[ctx.cmdOffset+1:]
-	if len(winStr) > 0 {
+	// parse win size (if there), and the suffix that says how to print
+	arg := ctx.cmd[ctx.cmdOffset+1:]
+	n := strings.IndexFunc(arg, func(r rune) bool { return r < '0' || r > '9' })
+	if n < 0 {
+		n = len(arg)
+	}
+	if n > 0 {
 		var win int
-		if win, e = strconv.Atoi(winStr); e != nil {
-			return fmt.Errorf("invalid window size: %s", winStr)
+		if win, e = strconv.Atoi(arg[:n]); e != nil || win < 1 {
+			return fmt.Errorf("invalid window size: %s", arg[:n])
 		}
-		state.winSize = win
-	}
-	end := start + state.winSize - 1
-	if end > buffer.Len()-1 {
-		end = buffer.Len() - 1
+		ed.winSize = win
 	}
-	var ls []string
-	if ls, e = buffer.Get([2]int{start, end}); e != nil {
+	var m printMode
+	if m, e = parseSuffix(arg[n:]); e != nil {
 		return
 	}
-	for _, l := range ls {
-		fmt.Println(l)
+	end := start + ed.winSize - 1
+	if end > ed.buffer.Len()-1 {
+		end = ed.buffer.Len() - 1
+	}
+	for l := start; l <= end; l++ {
+		if e = ed.printLine(l, m); e != nil {
+			return
+		}
 	}
 	return
 }
 
-func cmdErr(ctx *Context) (e error) {
+func (ed *Editor) cmdErr(ctx *Context) (e error) {
 	if ctx.cmd[ctx.cmdOffset] == 'h' {
-		if state.lastErr != nil {
-			fmt.Println(state.lastErr)
+		if ed.lastErr != nil {
+			fmt.Fprintln(ed.out, ed.lastErr)
 			return
 		}
 	}
 	if ctx.cmd[ctx.cmdOffset] == 'H' {
-		if state.printErr {
-			state.printErr = false
+		if ed.printErr {
+			ed.printErr = false
 			return
 		}
-		state.printErr = true
+		ed.printErr = true
 	}
 	return
 }
 
-func cmdInput(ctx *Context) (e error) {
-	scan := bufio.NewScanner(os.Stdin)
+func (ed *Editor) cmdInput(ctx *Context) (e error) {
+	scan := ed.input
 	nbuf := []string{}
-	if len(ctx.cmd[ctx.cmdOffset+1:]) != 0 && ctx.cmd[ctx.cmdOffset] != 'c' {
-		return fmt.Errorf("%c only takes a single line addres", ctx.cmd[ctx.cmdOffset])
-	}
 	for scan.Scan() {
 		line := scan.Text()
 		if line == "." {
@@ -155,45 +202,61 @@ func cmdInput(ctx *Context) (e error) {
 		}
 		nbuf = append(nbuf, line)
 	}
+	if e = scan.Err(); e != nil {
+		return
+	}
 	if len(nbuf) == 0 {
 		return
 	}
+	// we're supposed to allow 0, which is also the only address in an empty buffer
+	zero := ctx.addrs[len(ctx.addrs)-1] == -1 || ed.buffer.Len() == 0
 	switch ctx.cmd[ctx.cmdOffset] {
 	case 'i':
 		var line int
-		if line, e = buffer.AddrValue(ctx.addrs); e != nil {
-			return
+		if !zero {
+			if line, e = ed.buffer.AddrValue(ctx.addrs); e != nil {
+				return
+			}
 		}
-		e = buffer.Insert(line, nbuf)
+		e = ed.buffer.Insert(line, nbuf)
 	case 'a':
-		var line int
-		if line, e = buffer.AddrValue(ctx.addrs); e != nil {
-			return
+		line := -1
+		if !zero {
+			if line, e = ed.buffer.AddrValue(ctx.addrs); e != nil {
+				return
+			}
 		}
-		e = buffer.Insert(line+1, nbuf)
+		e = ed.buffer.Insert(line+1, nbuf)
 	case 'c':
 		var r [2]int
-		if r, e = buffer.AddrRange(ctx.addrs); e != nil {
+		if r, e = ed.buffer.AddrRange(ctx.addrs); e != nil {
+			return
+		}
+		var lines []string
+		if lines, e = ed.buffer.Get(r); e != nil {
 			return
 		}
-		buffer.Delete(r)
-		e = buffer.Insert(r[0], nbuf)
+		ed.buffer.Delete(r)
+		if e = ed.buffer.Insert(r[0], nbuf); e != nil {
+			return
+		}
+		e = ed.regs.put(ctx.reg, lines, true)
 	}
 	return
 }
 
 var rxWrite = regexp.MustCompile("^(q)?(?: )?(!)?(.*)")
 
-func cmdWrite(ctx *Context) (e error) {
-	file := state.fileName
+func (ed *Editor) cmdWrite(ctx *Context) (e error) {
+	file := ed.fileName
 	quit := false
 	run := false
 	var r [2]int
-	if ctx.cmdOffset == 0 {
+	if !ctx.addressed {
 		r[0] = 0
-		r[1] = buffer.Len() - 1
+		r[1] = ed.buffer.Len() - 1
 	} else {
-		if r, e = buffer.AddrRange(ctx.addrs); e != nil {
+		if r, e = ed.buffer.AddrRange(ctx.addrs); e != nil {
 			return
 		}
 	}
@@ -207,73 +270,83 @@ func cmdWrite(ctx *Context) (e error) {
 	if len(m[0][3]) > 0 {
 		file = m[0][3]
 	}
-	var lstr []string
-	lstr, e = buffer.Get(r)
-	if e != nil {
-		return
+	if !run {
+		if e = ed.restrictFile(file); e != nil {
+			return
+		}
 	}
 	if run {
-		s := System{
-			Cmd:    m[0][3],
-			Stdin:  bytes.NewBuffer(nil),
-			Stdout: os.Stdout,
-			Stderr: os.Stderr,
-		}
-		go func() {
-			for _, str := range lstr {
-				if _, e = fmt.Fprintf(s.Stdin.(*bytes.Buffer), "%s\n", str); e != nil {
-					return
-				}
-			}
-		}()
+		var s *System
+		if s, e = ed.shell(m[0][3], r); e != nil {
+			return
+		}
+		if s.Stdin, e = ed.buffer.Reader(r); e != nil {
+			return
+		}
 		return s.Run()
 	}
 
-	var f *os.File
-	oFlag := os.O_TRUNC
-	if ctx.cmd[ctx.cmdOffset] == 'W' {
-		oFlag = os.O_APPEND
-	}
-	if f, e = os.OpenFile(file, os.O_WRONLY|os.O_CREATE|oFlag, 0666); e != nil {
-		return e
+	var changed bool
+	if changed, e = ed.buffer.Changed(file); e != nil {
+		return
 	}
-	defer f.Close()
-
-	for _, s := range lstr {
-		_, e = fmt.Fprintf(f, "%s\n", s)
-		if e != nil {
+	if ctx.cmd[ctx.cmdOffset] == 'W' {
+		var f *os.File
+		if f, e = os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666); e != nil {
+			return e
+		}
+		defer f.Close()
+		if _, e = ed.buffer.Write(r, f); e != nil {
 			return
 		}
+		if !changed {
+			// what's on disk is still what we know about, plus what we added
+			ed.buffer.Restamp(file)
+		}
+	} else if changed && !ed.force {
+		ed.warned = ctx.cmd
+		return fmt.Errorf("warning: file changed on disk since last read or write")
+	} else if _, e = ed.buffer.WriteFile(r, file, ed.Backup); e != nil {
+		return
 	}
+	ed.buffer.Clean()
 	if quit {
-		cmdQuit(ctx)
+		return ed.cmdQuit(ctx)
 	}
-	buffer.Clean()
 	return
 }
 
-func cmdMark(ctx *Context) (e error) {
+func (ed *Editor) cmdMark(ctx *Context) (e error) {
 	if len(ctx.cmd)-1 <= ctx.cmdOffset {
 		e = fmt.Errorf("no mark character supplied")
 		return
 	}
 	c := ctx.cmd[ctx.cmdOffset+1]
+	if c < 'a' || c > 'z' {
+		return fmt.Errorf("invalid mark character: %c", c)
+	}
+	if len(ctx.cmd) > ctx.cmdOffset+2 {
+		return ErrSuffix
+	}
 	var l int
-	if l, e = buffer.AddrValue(ctx.addrs); e != nil {
+	if l, e = ed.buffer.AddrValue(ctx.addrs); e != nil {
 		return
 	}
-	e = buffer.SetMark(c, l)
+	e = ed.buffer.SetMark(c, l)
 	return
 }
 
-func cmdEdit(ctx *Context) (e error) {
+func (ed *Editor) cmdEdit(ctx *Context) (e error) {
 	var addr int
-	// we do this manually because we allow addr 0
+	// we do this manually because we allow addr 0 (which is -1 to us)
 	if len(ctx.addrs) == 0 {
 		return ErrINV
 	}
 	addr = ctx.addrs[len(ctx.addrs)-1]
-	if addr != 0 && buffer.OOB(addr) {
+	if !ctx.addressed { // r defaults to reading after the last line
+		addr = ed.buffer.Len() - 1
+	}
+	if addr != -1 && ed.buffer.OOB(addr) {
 		return ErrOOB
 	}
 	// cmd or filename?
@@ -282,74 +355,101 @@ func cmdEdit(ctx *Context) (e error) {
 	if cmd == 'E' || cmd == 'r' {
 		force = true
 	} // else == 'e'
-	if buffer.Dirty() && !force {
+	if ed.buffer.Dirty() && !force {
 		return fmt.Errorf("warning: file modified")
 	}
 	filename := ctx.cmd[ctx.cmdOffset+1:]
 	filename = filename[wsOffset(filename):]
 	var fh io.Reader
+	var nb *FileBuffer
+	if len(filename) == 0 {
+		filename = ed.fileName
+	}
 	if len(filename) == 0 {
-		filename = state.fileName
+		return fmt.Errorf("no current filename")
 	}
 	if filename[0] == '!' { // command, not filename
-		s := System{
-			Cmd:    filename[1:],
-			Stdout: bytes.NewBuffer(nil),
-			Stdin:  os.Stdin,
-			Stderr: os.Stderr,
+		var s *System
+		if s, e = ed.shell(filename[1:], [2]int{addr, addr}); e != nil {
+			return
 		}
+		out := bytes.NewBuffer(nil)
+		ed.capture(s, out)
 		if e = s.Run(); e != nil {
 			return
 		}
-		fh = s.Stdout.(io.Reader)
+		fh = out
 	} else { // filename
-		if _, e = os.Stat(filename); os.IsNotExist(e) && !*fSuppress {
+		if e = ed.restrictFile(filename); e != nil {
+			return
+		}
+		if _, e = os.Stat(filename); os.IsNotExist(e) && !ed.Suppress {
 			return fmt.Errorf("%s: No such file or directory", filename)
 			// this is not fatal, we just start with an empty buffer
 		}
-		if fh, e = os.Open(filename); e != nil {
-			e = fmt.Errorf("could not read file: %v", e)
-			return
+		if cmd != 'r' {
+			// the new buffer needs to know what the file looked like
+			if nb, e = FileToBuffer(filename); e != nil {
+				return
+			}
+		} else {
+			var f *os.File
+			if f, e = os.Open(filename); e != nil {
+				e = fmt.Errorf("could not read file: %v", e)
+				return
+			}
+			defer f.Close()
+			fh = f
 		}
-		state.fileName = filename
+		ed.fileName = filename
 	}
 
 	if cmd != 'r' { // other commands replace
-		buffer = NewFileBuffer(nil)
-		if e = buffer.Read(0, fh); e != nil {
-			return
+		if nb == nil {
+			if nb, e = ReaderToBuffer(fh); e != nil {
+				return
+			}
 		}
-	} else {
-		e = buffer.Read(addr, fh)
+		ed.buffer = nb
+		ed.buffer.SetHistory(ed.History)
+		ed.openSwap(false)
+	} else if e = ed.buffer.Read(addr+1, fh); e != nil {
+		return
+	}
+	if ed.buffer.NewlineAppended() && !ed.Suppress {
+		fmt.Fprintln(ed.Stderr, "Newline appended")
 	}
-	if !*fSuppress {
-		fmt.Println(buffer.Size())
+	if !ed.Suppress {
+		fmt.Fprintln(ed.out, ed.buffer.Size())
 	}
 	return
 }
 
-func cmdFile(ctx *Context) (e error) {
-	newFile := ctx.cmd[ctx.cmdOffset:]
+func (ed *Editor) cmdFile(ctx *Context) (e error) {
+	newFile := ctx.cmd[ctx.cmdOffset+1:]
 	newFile = newFile[wsOffset(newFile):]
 	if len(newFile) > 0 {
-		state.fileName = newFile
+		if e = ed.restrictFile(newFile); e != nil {
+			return
+		}
+		ed.fileName = newFile
 		return
 	}
-	fmt.Println(state.fileName)
+	fmt.Fprintln(ed.out, ed.fileName)
 	return
 }
 
-func cmdLine(ctx *Context) (e error) {
-	addr, e := buffer.AddrValue(ctx.addrs)
+func (ed *Editor) cmdLine(ctx *Context) (e error) {
+	addr, e := ed.buffer.AddrValue(ctx.addrs)
 	if e == nil {
-		fmt.Println(addr + 1)
+		fmt.Fprintln(ed.out, addr+1)
 	}
 	return
 }
 
-func cmdJoin(ctx *Context) (e error) {
+func (ed *Editor) cmdJoin(ctx *Context) (e error) {
 	var r [2]int
-	if r, e = buffer.AddrRangeOrLine(ctx.addrs); e != nil {
+	if r, e = ed.buffer.AddrRangeOrLine(ctx.addrs); e != nil {
 		return
 	}
 	// Technically only a range works, but a line isn't an error
@@ -357,29 +457,50 @@ func cmdJoin(ctx *Context) (e error) {
 		return
 	}
 
-	joined := ""
-	for l := r[0]; l <= r[1]; l++ {
-		joined += buffer.GetMust(l, false)
+	var lines []string
+	if lines, e = ed.buffer.Get(r); e != nil {
+		return
 	}
-	if e = buffer.Delete(r); e != nil {
+	if e = ed.buffer.Delete(r); e != nil {
 		return
 	}
-	e = buffer.Insert(r[0], []string{joined})
-	return
+	if e = ed.buffer.Insert(r[0], []string{strings.Join(lines, "")}); e != nil {
+		return
+	}
+	// as in GNU ed, the lines that were joined are cut
+	return ed.regs.put(0, lines, true)
 }
 
-func cmdMove(ctx *Context) (e error) {
+func (ed *Editor) cmdMove(ctx *Context) (e error) {
 	var r [2]int
 	var dest int
 	var lines []string
 	cmd := ctx.cmd[ctx.cmdOffset]
-	if r, e = buffer.AddrRangeOrLine(ctx.addrs); e != nil {
+	if r, e = ed.buffer.AddrRangeOrLine(ctx.addrs); e != nil {
 		return
 	}
-	// must parse the destination
+	// must parse the destination, which may be in another buffer
 	destStr := ctx.cmd[ctx.cmdOffset+1:]
+	to := ed.cur
+	if m := rxBufferDest.FindStringSubmatch(destStr); m != nil {
+		if to, e = ed.findBuffer(m[1]); e != nil {
+			return
+		}
+		destStr = destStr[len(m[0]):]
+	}
+	dst := ed.buffer
+	if to != ed.cur {
+		dst = to.buffer
+		dst.re = ed.re
+	}
 	var nctx Context
-	if nctx.addrs, nctx.cmdOffset, e = buffer.ResolveAddrs(destStr); e != nil {
+	if nctx.addrs, nctx.cmdOffset, e = dst.ResolveAddrs(destStr); e != nil {
+		return
+	}
+	if len(nctx.addrs) == 0 {
+		return fmt.Errorf("destination expected")
+	}
+	if ctx.print, e = parseSuffix(destStr[nctx.cmdOffset:]); e != nil {
 		return
 	}
 	// this is a bit hacky, but we're supposed to allow 0
@@ -389,42 +510,35 @@ func cmdMove(ctx *Context) (e error) {
 		nctx.addrs[last] = 0
 		append = 0
 	}
-	if dest, e = buffer.AddrValue(nctx.addrs); e != nil {
+	if dest, e = dst.AddrValue(nctx.addrs); e != nil {
 		return
 	}
-
-	if lines, e = buffer.Get(r); e != nil {
-		return
-	}
-	delt := r[1] - r[0] + 1
-	if dest < r[0] {
-		r[0] += delt
-		r[1] += delt
-	} else if dest > r[1] {
-		//NOP
-	} else {
-		return fmt.Errorf("cannot move lines to within their own range")
+	if to != ed.cur {
+		return ed.copyTo(cmd, r, to, dest+append)
 	}
 
-	// Should we throw an error if there's trailing stuff?
-	if e = buffer.Insert(dest+append, lines); e != nil {
-		return
-	}
 	if cmd == 'm' {
-		e = buffer.Delete(r)
+		return ed.buffer.Move(r, dest+append)
 	} // else 't'
-	return
+	if lines, e = ed.buffer.Get(r); e != nil {
+		return
+	}
+	return ed.buffer.Insert(dest+append, lines)
 }
 
-func cmdCopy(ctx *Context) (e error) {
+func (ed *Editor) cmdCopy(ctx *Context) (e error) {
 	var r [2]int
-	if r, e = buffer.AddrRangeOrLine(ctx.addrs); e != nil {
+	if r, e = ed.buffer.AddrRangeOrLine(ctx.addrs); e != nil {
 		return
 	}
-	return buffer.Copy(r)
+	var lines []string
+	if lines, e = ed.buffer.Get(r); e != nil {
+		return
+	}
+	return ed.regs.put(ctx.reg, lines, false)
 }
 
-func cmdPaste(ctx *Context) (e error) {
+func (ed *Editor) cmdPaste(ctx *Context) (e error) {
 	var addr int
 	// this is a bit hacky, but we're supposed to allow 0
 	append := 1
@@ -433,17 +547,21 @@ func cmdPaste(ctx *Context) (e error) {
 		ctx.addrs[last] = 0
 		append = 0
 	}
-	if addr, e = buffer.AddrValue(ctx.addrs); e != nil {
+	var lines []string
+	if lines, e = ed.regs.get(ctx.reg); e != nil {
 		return
 	}
-	return buffer.Paste(addr + append)
+	if addr, e = ed.buffer.AddrValue(ctx.addrs); e != nil {
+		return
+	}
+	return ed.buffer.Insert(addr+append, lines)
 }
 
-func cmdPrompt(ctx *Context) (e error) {
-	if state.prompt {
-		state.prompt = false
-	} else if len(*fPrompt) > 0 {
-		state.prompt = true
+func (ed *Editor) cmdPrompt(ctx *Context) (e error) {
+	if ed.ShowPrompt {
+		ed.ShowPrompt = false
+	} else if len(ed.Prompt) > 0 {
+		ed.ShowPrompt = true
 	}
 	return
 }
@@ -452,17 +570,18 @@ var rxSanitize = regexp.MustCompile("\\\\.")
 var rxBackrefSanitize = regexp.MustCompile("\\\\\\\\")
 var rxBackref = regexp.MustCompile("\\\\([0-9]+)|&")
 var rxSubArgs = regexp.MustCompile("g|l|n|p|\\d+")
+var rxSubArgsAll = regexp.MustCompile("^(?:g|l|n|p|\\d+)*$")
 
 // FIXME: this is probably more convoluted than it needs to be
-func cmdSub(ctx *Context) (e error) {
+func (ed *Editor) cmdSub(ctx *Context) (e error) {
 	cmd := ctx.cmd[ctx.cmdOffset+1:]
 	if len(cmd) == 0 {
-		if len(state.lastSub) == 0 {
+		if len(ed.lastSub) == 0 {
 			return fmt.Errorf("invalid substitution")
 		}
-		cmd = state.lastSub
+		cmd = ed.lastSub
 	}
-	state.lastSub = cmd
+	ed.lastSub = cmd
 	del := cmd[0]
 	switch del {
 	case ' ':
@@ -489,26 +608,27 @@ func cmdSub(ctx *Context) (e error) {
 	mat := cmd[1:idx[0]]
 	rep := cmd[idx[0]+1 : idx[1]]
 	if rep == "%" {
-		rep = state.lastRep
+		rep = ed.lastRep
 	}
-	state.lastRep = rep
+	ed.lastRep = rep
 	arg := cmd[idx[1]+1:]
 
 	// arg processing
 	var count = 1
-	var printP, printL, printN, global bool
+	var global bool
+	var suffix printMode
 
+	if !rxSubArgsAll.MatchString(arg) {
+		return ErrSuffix
+	}
 	parsedArgs := rxSubArgs.FindAllStringSubmatch(arg, -1)
 	for _, m := range parsedArgs {
 		switch m[0] {
 		case "g":
 			global = true
-		case "p":
-			printP = true
-		case "l":
-			printL = true
-		case "n":
-			printN = true
+		case "p", "l", "n":
+			pm, _ := parseSuffix(m[0])
+			suffix |= pm
 		default:
 			if count, e = strconv.Atoi(m[0]); e != nil || count < 1 {
 				return fmt.Errorf("invalid substitution argument")
@@ -520,21 +640,22 @@ func cmdSub(ctx *Context) (e error) {
 	refs := rxBackref.FindAllStringSubmatchIndex(repSane, -1)
 
 	var r [2]int
-	if r, e = buffer.AddrRangeOrLine(ctx.addrs); e != nil {
+	if r, e = ed.buffer.AddrRangeOrLine(ctx.addrs); e != nil {
 		return
 	}
 
 	var rx *regexp.Regexp
-	if rx, e = regexp.Compile(mat); e != nil {
+	if rx, e = ed.re.compile(mat); e != nil {
 		return
 	}
 
-	last := ""
-	lastN := 0
 	nMatch := 0
-	b, _ := buffer.Get(r)
+	b, _ := ed.buffer.Get(r)
 	// we have to do things a bit manually because we we only have ReplaceAll, and we don't necessarily want that
 	for ln, l := range b {
+		if ed.buffer.Interrupted() {
+			return ErrInterrupt
+		}
 		matches := rx.FindAllStringSubmatchIndex(l, -1)
 		if !(len(matches) > 0) {
 			continue // skip the rest if we don't have matches
@@ -579,50 +700,357 @@ func cmdSub(ctx *Context) (e error) {
 			oLin = m[1]
 		}
 		fLin += l[oLin:]
-		buffer.Delete([2]int{ln, ln})
-		buffer.Insert(ln, []string{fLin})
-		last = fLin
-		lastN = ln
+		ed.buffer.Delete([2]int{r[0] + ln, r[0] + ln})
+		ed.buffer.Insert(r[0]+ln, []string{fLin})
 	}
-	if nMatch == 0 {
+	if nMatch == 0 && ed.inGlobal {
+		// not matching some of the lines is expected in a global command
+	} else if nMatch == 0 {
 		e = fmt.Errorf("no match")
 	} else {
-		if printP {
-			fmt.Println(last)
+		// the last line we substituted is the current line
+		ctx.print = suffix
+	}
+	return
+}
+
+func (ed *Editor) cmdUndo(ctx *Context) (e error) {
+	if ctx.cmd[ctx.cmdOffset] == 'U' {
+		return ed.buffer.Forward()
+	}
+	return ed.buffer.Rewind()
+}
+
+// cmdUndoTree lists the undo tree (T), jumps to a state by number (Tn),
+// or returns to the state the file was in some time ago (T-<minutes> or T-<duration>)
+func (ed *Editor) cmdUndoTree(ctx *Context) (e error) {
+	arg := ctx.cmd[ctx.cmdOffset+1:]
+	arg = arg[wsOffset(arg):]
+	switch {
+	case len(arg) == 0:
+		for _, n := range ed.buffer.UndoTree() {
+			cur := " "
+			if n.Current {
+				cur = "*"
+			}
+			parent := "-"
+			if n.Parent >= 0 {
+				parent = strconv.Itoa(n.Parent)
+			}
+			fmt.Fprintf(ed.out, "%s%d\t%s\t%s\t%d\n", cur, n.Seq, parent, n.Time.Format("15:04:05"), n.Lines)
 		}
-		if printL {
-			fmt.Println(last + "$")
+	case arg[0] == '-':
+		var d time.Duration
+		if m, err := strconv.Atoi(arg[1:]); err == nil {
+			d = time.Duration(m) * time.Minute
+		} else if d, e = time.ParseDuration(arg[1:]); e != nil {
+			return fmt.Errorf("invalid time: %s", arg[1:])
 		}
-		if printN {
-			fmt.Printf("%d\t%s\n", lastN+1, last)
+		e = ed.buffer.UndoAt(time.Now().Add(-d))
+	default:
+		var seq int
+		if seq, e = strconv.Atoi(arg); e != nil {
+			return fmt.Errorf("invalid undo state: %s", arg)
+		}
+		e = ed.buffer.UndoTo(seq)
+	}
+	return
+}
+
+// cmdLineEnding prints the line ending style of the buffer (N), or converts it (N lf|crlf|eol|noeol ...)
+func (ed *Editor) cmdLineEnding(ctx *Context) (e error) {
+	crlf, eol := ed.buffer.LineEnding()
+	args := strings.Fields(ctx.cmd[ctx.cmdOffset+1:])
+	if len(args) == 0 {
+		style := []string{"lf", "eol"}
+		if crlf {
+			style[0] = "crlf"
+		}
+		if !eol {
+			style[1] = "noeol"
+		}
+		fmt.Fprintln(ed.out, strings.Join(style, " "))
+		return
+	}
+	for _, a := range args {
+		switch a {
+		case "lf":
+			crlf = false
+		case "crlf":
+			crlf = true
+		case "eol":
+			eol = true
+		case "noeol":
+			eol = false
+		default:
+			return fmt.Errorf("invalid line ending: %s", a)
 		}
 	}
+	ed.buffer.SetLineEnding(crlf, eol)
 	return
 }
 
-func cmdUndo(ctx *Context) (e error) {
-	buffer.Rewind()
+// cmdCompare shows how the buffer differs from the file on disk (C [file]), like diff(1)
+func (ed *Editor) cmdCompare(ctx *Context) (e error) {
+	file := ctx.cmd[ctx.cmdOffset+1:]
+	file = file[wsOffset(file):]
+	if len(file) == 0 {
+		file = ed.fileName
+	}
+	if len(file) == 0 {
+		return fmt.Errorf("no current filename")
+	}
+	if e = ed.restrictFile(file); e != nil {
+		return
+	}
+	var disk *FileBuffer
+	if disk, e = FileToBuffer(file); e != nil {
+		return
+	}
+	a, b := disk.Lines(), ed.buffer.Lines()
+	return writeDiff(ed.out, a, b, diff(a, b))
+}
+
+func (ed *Editor) cmdDump(ctx *Context) (e error) {
+	fmt.Fprintf(ed.out, "%v\n", ed.buffer)
+	return
+}
+
+func (ed *Editor) cmdCommand(ctx *Context) (e error) {
+	if ctx.addressed {
+		return ed.cmdFilter(ctx)
+	}
+	var s *System
+	l := ed.buffer.GetAddr()
+	if s, e = ed.shell(ctx.cmd[ctx.cmdOffset+1:], [2]int{l, l}); e != nil {
+		return
+	}
+	if e = s.Run(); e != nil {
+		return
+	}
+	fmt.Fprintln(ed.out, "!")
 	return
 }
 
-func cmdDump(ctx *Context) (e error) {
-	fmt.Printf("%v\n", buffer)
+// shell prepares a shell command for !, r !, e !, w ! and filters.  ed's substitutions are made (see ExpandCommand),
+// the result is remembered for the next !!, and it's printed if it changed.
+// r is the range of lines the command works on, which is given to it in the environment along with the rest of
+// where the editor is (see shellEnv).
+func (ed *Editor) shell(cmd string, r [2]int) (s *System, e error) {
+	if ed.Restrict {
+		return nil, ErrRestrictShell
+	}
+	var changed bool
+	if cmd, changed, e = ExpandCommand(cmd, ed.fileName, ed.lastShell); e != nil {
+		return
+	}
+	ed.lastShell = cmd
+	if changed && !ed.Suppress {
+		fmt.Fprintln(ed.out, cmd)
+	}
+	s = &System{
+		Cmd:       cmd,
+		Stdin:     ed.ShellStdin,
+		Stdout:    ed.out,
+		Stderr:    ed.Stderr,
+		Env:       ed.shellEnv(r),
+		Interrupt: ed.done,
+		Timeout:   ed.ShellTimeout,
+	}
 	return
 }
 
-var rxCmdSub = regexp.MustCompile("%")
+// shellEnv is the environment a shell command is run with, so scripts can tell where the editor is:
+//
+//	GED_FILE   the current filename
+//	GED_LINE   the current line
+//	GED_LINES  the number of lines in the buffer
+//	GED_DIRTY  1 if the buffer has unsaved changes, otherwise 0
+//	GED_FIRST  the first line of the range the command works on
+//	GED_LAST   the last line of the range
+//
+// Lines are numbered from 1, as ed numbers them, and are 0 if the buffer is empty.
+func (ed *Editor) shellEnv(r [2]int) []string {
+	dirty := 0
+	if ed.buffer.Dirty() {
+		dirty = 1
+	}
+	line := ed.buffer.GetAddr()
+	if ed.buffer.Len() == 0 {
+		line, r = -1, [2]int{-1, -1}
+	}
+	return []string{
+		"GED_FILE=" + ed.fileName,
+		fmt.Sprintf("GED_LINE=%d", line+1),
+		fmt.Sprintf("GED_LINES=%d", ed.buffer.Len()),
+		fmt.Sprintf("GED_DIRTY=%d", dirty),
+		fmt.Sprintf("GED_FIRST=%d", r[0]+1),
+		fmt.Sprintf("GED_LAST=%d", r[1]+1),
+	}
+}
+
+// capture sends a shell command's output to out, to be read into the buffer, limited to ShellMaxOutput bytes
+func (ed *Editor) capture(s *System, out io.Writer) {
+	s.Stdout = out
+	s.MaxOutput = ed.ShellMaxOutput
+	if ed.ShellStderr {
+		s.Stderr = out
+	}
+}
 
-func cmdCommand(ctx *Context) (e error) {
-	s := System{
-		Cmd:    ctx.cmd[ctx.cmdOffset+1:],
-		Stdin:  os.Stdin,
-		Stdout: os.Stdout,
-		Stderr: os.Stderr,
+// cmdFilter pipes lines through a shell command and replaces them with its output (addr,addr!cmd).
+// If the command fails, or is stopped by one of the shell limits, the lines are left as they were.
+func (ed *Editor) cmdFilter(ctx *Context) (e error) {
+	var r [2]int
+	if r, e = ed.buffer.AddrRangeOrLine(ctx.addrs); e != nil {
+		return
 	}
-	e = s.Run()
-	if e != nil {
+	var s *System
+	if s, e = ed.shell(ctx.cmd[ctx.cmdOffset+1:], r); e != nil {
+		return
+	}
+	if s.Stdin, e = ed.buffer.Reader(r); e != nil {
+		return
+	}
+	out := bytes.NewBuffer(nil)
+	ed.capture(s, out)
+	if e = s.Run(); e != nil {
+		return
+	}
+	size := out.Len()
+	if e = ed.buffer.Delete(r); e != nil {
+		return
+	}
+	if e = ed.buffer.Read(r[0], out); e != nil {
+		return
+	}
+	if !ed.Suppress {
+		fmt.Fprintln(ed.out, size)
+	}
+	return
+}
+
+func (ed *Editor) cmdGlobal(ctx *Context) (e error) {
+	if ed.inGlobal {
+		return fmt.Errorf("cannot nest global commands")
+	}
+	cmd := ctx.cmd[ctx.cmdOffset]
+	invert := cmd == 'v' || cmd == 'V'
+	interactive := cmd == 'G' || cmd == 'V'
+	var r [2]int
+	if !ctx.addressed {
+		r[0] = 0
+		r[1] = ed.buffer.Len() - 1
+	} else {
+		if r, e = ed.buffer.AddrRangeOrLine(ctx.addrs); e != nil {
+			return
+		}
+	}
+
+	// parse the pattern and command list
+	arg := ctx.cmd[ctx.cmdOffset+1:]
+	if len(arg) == 0 {
+		return fmt.Errorf("missing pattern delimiter")
+	}
+	del := arg[0]
+	if del == ' ' || del == '\n' {
+		return fmt.Errorf("invalid pattern delimiter")
+	}
+	sane := rxSanitize.ReplaceAllString(arg, "  ")
+	idx := strings.IndexByte(sane[1:], del) + 1
+	if idx == 0 {
+		return fmt.Errorf("missing pattern delimiter")
+	}
+	pat := arg[1:idx]
+	list := arg[idx+1:]
+	if interactive && len(list) > 0 {
+		return ErrSuffix
+	}
+	if list, e = ed.readCmdList(list); e != nil {
 		return
 	}
-	fmt.Println("!")
+	if len(list) == 0 {
+		list = "p"
+	}
+
+	var rx *regexp.Regexp
+	if rx, e = ed.re.compile(pat); e != nil {
+		return
+	}
+	for l := r[0]; l <= r[1]; l++ {
+		if ed.buffer.Interrupted() {
+			return ErrInterrupt
+		}
+		if rx.MatchString(ed.buffer.GetMust(l, false)) != invert {
+			ed.buffer.GlobalMark(l)
+		}
+	}
+
+	ed.inGlobal = true
+	defer func() {
+		ed.inGlobal = false
+		ed.buffer.GlobalClear()
+	}()
+	for {
+		if ed.buffer.Interrupted() {
+			return ErrInterrupt
+		}
+		l, ok := ed.buffer.GlobalNext()
+		if !ok {
+			break
+		}
+		ed.buffer.SetAddr(l)
+		if interactive {
+			fmt.Fprintln(ed.out, ed.buffer.GetMust(l, false))
+			if !ed.input.Scan() {
+				break
+			}
+			list = ed.input.Text()
+			switch list {
+			case "":
+				continue
+			case "&":
+				if len(ed.lastGlob) == 0 {
+					return fmt.Errorf("no previous command")
+				}
+				list = ed.lastGlob
+			default:
+				if list, e = ed.readCmdList(list); e != nil {
+					return
+				}
+			}
+			ed.lastGlob = list
+		}
+		if e = ed.executeList(list); e != nil {
+			return
+		}
+	}
+	return
+}
+
+// readCmdList reads the rest of a command list, which continues as long as lines end in a backslash
+func (ed *Editor) readCmdList(list string) (string, error) {
+	full := ""
+	for strings.HasSuffix(list, "\\") {
+		full += list[:len(list)-1] + "\n"
+		if !ed.input.Scan() {
+			return full, ed.input.Err()
+		}
+		list = ed.input.Text()
+	}
+	return full + list, nil
+}
+
+// executeList runs each command in a newline separated list
+// Commands that take input (a, i, c) read it from the list.
+func (ed *Editor) executeList(list string) (e error) {
+	in := ed.input
+	ed.input = newLineReader(strings.NewReader(list))
+	defer func() { ed.input = in }()
+	for ed.input.Scan() {
+		if e = ed.execute(ed.input.Text()); e != nil {
+			return
+		}
+	}
 	return
 }
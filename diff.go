@@ -0,0 +1,141 @@
+// diff.go - compares lines of text, so we can show how a buffer differs from its file
+package ged
+
+import (
+	"fmt"
+	"io"
+)
+
+// A hunk replaces the lines a[a0:a1] with b[b0:b1]
+type hunk struct {
+	a0, a1 int
+	b0, b1 int
+}
+
+// maxDiffCost limits how hard diff works to find the shortest edit, since the trace it keeps grows
+// with the square of the number of edits.  Past this, the rest is shown as one big change.
+const maxDiffCost = 4096
+
+// diff finds the hunks that turn a into b, using Myers' O(ND) algorithm
+func diff(a, b []string) (hunks []hunk) {
+	// the lines at the start and end that didn't change don't need searching
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+	a, b = a[pre:len(a)-suf], b[pre:len(b)-suf]
+	n, m := len(a), len(b)
+	if n == 0 && m == 0 {
+		return
+	}
+
+	// v[max+k] is the furthest x reached on diagonal k = x-y, trace[d] keeps diagonals -d..d of v after d edits
+	max := n + m
+	v := make([]int, 2*max+2)
+	var trace [][]int
+	found := false
+	for d := 0; d <= max && !found; d++ {
+		if d > maxDiffCost {
+			return []hunk{{pre, pre + n, pre, pre + m}}
+		}
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[max+k-1] < v[max+k+1]) {
+				x = v[max+k+1] // down: insert b[y]
+			} else {
+				x = v[max+k-1] + 1 // right: delete a[x]
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[max+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+		trace = append(trace, append([]int(nil), v[max-d:max+d+1]...))
+	}
+
+	// walk back along the path to find which lines were deleted and inserted
+	del := make([]bool, n)
+	ins := make([]bool, m)
+	x, y := n, m
+	for d := len(trace) - 1; d > 0; d-- {
+		prev := trace[d-1] // diagonal k is at prev[k+d-1]
+		k := x - y
+		if k == -d || (k != d && prev[k-1+d-1] < prev[k+1+d-1]) {
+			x = prev[k+1+d-1]
+			y = x - k - 1
+			ins[y] = true
+		} else {
+			x = prev[k-1+d-1]
+			y = x - k + 1
+			del[x] = true
+		}
+	}
+
+	// lines that were neither deleted nor inserted match up in order, so the rest make the hunks
+	for i, j := 0, 0; i < n || j < m; {
+		if i < n && j < m && !del[i] && !ins[j] {
+			i++
+			j++
+			continue
+		}
+		h := hunk{a0: pre + i, b0: pre + j}
+		for i < n && del[i] {
+			i++
+		}
+		for j < m && ins[j] {
+			j++
+		}
+		h.a1, h.b1 = pre+i, pre+j
+		hunks = append(hunks, h)
+	}
+	return
+}
+
+// writeDiff writes the hunks that turn a into b, in the "normal" format of diff(1)
+func writeDiff(w io.Writer, a, b []string, hunks []hunk) (e error) {
+	lines := func(l0, l1 int) string {
+		if l1-l0 == 1 {
+			return fmt.Sprint(l1)
+		}
+		return fmt.Sprintf("%d,%d", l0+1, l1)
+	}
+	for _, h := range hunks {
+		switch {
+		case h.a0 == h.a1:
+			_, e = fmt.Fprintf(w, "%da%s\n", h.a0, lines(h.b0, h.b1))
+		case h.b0 == h.b1:
+			_, e = fmt.Fprintf(w, "%sd%d\n", lines(h.a0, h.a1), h.b0)
+		default:
+			_, e = fmt.Fprintf(w, "%sc%s\n", lines(h.a0, h.a1), lines(h.b0, h.b1))
+		}
+		if e != nil {
+			return
+		}
+		for _, l := range a[h.a0:h.a1] {
+			if _, e = fmt.Fprintf(w, "< %s\n", l); e != nil {
+				return
+			}
+		}
+		if h.a0 != h.a1 && h.b0 != h.b1 {
+			if _, e = fmt.Fprintln(w, "---"); e != nil {
+				return
+			}
+		}
+		for _, l := range b[h.b0:h.b1] {
+			if _, e = fmt.Fprintf(w, "> %s\n", l); e != nil {
+				return
+			}
+		}
+	}
+	return
+}
@@ -1,8 +1,8 @@
 // filebuffer.go - defines the FileBuffer object
-package main
+package ged
 
 import (
-	"bufio"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"os"
@@ -10,37 +10,43 @@ import (
 
 // A FileBuffer manages a file being edited.
 // A FileBuffer never deletes/modifies anything directly until it is replaced.
-// It keeps a map of known lines to the current buffer.
+// It keeps a map of known lines to the current buffer, as a piece table (see lineMap).
 // Note: FileBuffer is 0-addressed lines, so off-by-one from what `ed` expects.
 type FileBuffer struct {
-	cbuf      []string // cut buffer
-	buffer    []string // all lines we know about, they never get delited
-	file      []int    // sequence of buffer lines
-	lastFile  []int    // used for undo capability
-	tmpFile   []int    // used for undo capability
-	dirty     bool     // tracks if the file has been modifed
-	lastDirty bool     // used for undo capability
-	tmpDirty  bool     // used for undo capability
-	mod       bool     // mod is like dirty, but can be reset for transactions
-	addr      int      // current file address
-	lastAddr  int      // last address (for undo)
-	tmpAddr   int      // last address (for undo)
-	marks     map[byte]int
+	buffer  []string    // all lines we know about, they never get delited
+	file    lineMap     // sequence of buffer lines
+	dirty   bool        // tracks if the file has been modifed
+	mod     bool        // mod is like dirty, but can be reset for transactions
+	addr    int         // current file address
+	undo    *undoNode   // current state in the undo tree
+	tree    []*undoNode // every state in the undo tree, oldest first
+	seq     int         // number of the next undo tree state
+	tmp     snapshot    // state at the start of the current transaction
+	tmpUndo *undoNode   // undo tree state at the start of the current transaction
+	history int         // maximum depth of the undo history, 0 is unlimited
+	re      *regexps    // compiles regular expressions in addresses
+	marks   map[byte]int
+	gmarks  []int           // buffer lines marked by a global command, in file order
+	crlf    bool            // lines end in \r\n rather than \n
+	noEOL   bool            // the last line has no line ending
+	nlAdded bool            // the last Read had to add a line ending to its last line
+	disk    fileStamp       // the file as we last read or wrote it
+	journal *journal        // swap journal of every transaction, nil for none
+	jumped  bool            // the current transaction restored a state from the undo tree
+	done    <-chan struct{} // closed to interrupt long operations
 }
 
 // NewFileBuffer creats a new FileBuffer object
 func NewFileBuffer(in []string) *FileBuffer {
 	f := &FileBuffer{
+		re:     &regexps{},
 		buffer: in,
-		file:   []int{},
 		dirty:  false,
 		mod:    false,
 		addr:   0,
 		marks:  make(map[byte]int),
 	}
-	for i := range f.buffer {
-		f.file = append(f.file, i)
-	}
+	f.file.Insert(0, 0, len(in))
 	return f
 }
 
@@ -50,6 +56,29 @@ var ErrOOB = fmt.Errorf("line is out of bounds")
 // ErrINV address is invalid
 var ErrINV = fmt.Errorf("invalid address")
 
+// ErrInterrupt an operation was interrupted
+var ErrInterrupt = fmt.Errorf("interrupted")
+
+// SetInterrupt sets a channel that interrupts long operations, such as searching, when it's closed
+func (f *FileBuffer) SetInterrupt(done <-chan struct{}) {
+	f.done = done
+}
+
+// Interrupted checks whether long operations should stop (and return ErrInterrupt)
+func (f *FileBuffer) Interrupted() bool {
+	select {
+	case <-f.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// SetExtended sets whether regular expressions in addresses are POSIX extended (ERE) rather than basic (BRE)
+func (f *FileBuffer) SetExtended(extended bool) {
+	f.re.extended = extended
+}
+
 // OOB checks if a line is out of bounds
 func (f *FileBuffer) OOB(l int) bool {
 	if l < 0 || l >= f.Len() {
@@ -64,7 +93,7 @@ func (f *FileBuffer) GetMust(line int, set bool) string {
 	if set {
 		f.addr = line
 	}
-	return f.buffer[f.file[line]]
+	return f.buffer[f.file.At(line)]
 }
 
 // Get a specified line range
@@ -74,50 +103,29 @@ func (f *FileBuffer) Get(r [2]int) (lines []string, e error) {
 		e = ErrOOB
 		return
 	}
+	if r[0] <= r[1] {
+		lines = make([]string, 0, r[1]-r[0]+1)
+	}
 	for l := r[0]; l <= r[1]; l++ {
-		lines = append(lines, f.buffer[f.file[l]])
+		lines = append(lines, f.buffer[f.file.At(l)])
 		f.addr = l
 	}
 	return
 }
 
-// Copy lines into the cut buffer
-func (f *FileBuffer) Copy(r [2]int) (e error) {
-	var lines []string
-	if lines, e = f.Get(r); e != nil {
-		return
-	}
-	f.cbuf = lines
-	return
-}
-
-// Paste lines from cut buffer insert at line
-func (f *FileBuffer) Paste(line int) (e error) {
-	e = f.Insert(line, f.cbuf)
-	return
-}
-
 // Delete unmaps lines from the file
 func (f *FileBuffer) Delete(r [2]int) (e error) {
-	blines := []int{}
-	for l := r[0]; l <= r[1]; l++ {
-		if f.OOB(l) {
-			return ErrOOB
-		}
-		blines = append(blines, f.file[l])
-	}
-	f.cbuf, _ = f.Get(r) // this shouldn't fail here, if it does we've got a bigger problem
-	for _, b := range blines {
-		for i, l := range f.file {
-			if l == b {
-				f.file = append(f.file[:i], f.file[i+1:]...)
-				break
-			}
-		}
+	if f.OOB(r[0]) || f.OOB(r[1]) || r[0] > r[1] {
+		return ErrOOB
 	}
+	f.file.Delete(r[0], r[1]-r[0]+1)
 	f.Touch()
-	f.addr = r[0] + 1
+	// the current line is the one after the lines deleted, or the new last line if there isn't one
+	f.addr = r[0]
 	if f.OOB(f.addr) {
+		f.addr = f.Len() - 1
+	}
+	if f.addr < 0 {
 		f.addr = 0
 	}
 	return
@@ -133,19 +141,46 @@ func (f *FileBuffer) Insert(line int, nlines []string) (e error) {
 	}
 	first := len(f.buffer)
 	f.buffer = append(f.buffer, nlines...)
-	nf := []int{}
-	for i := first; i < len(f.buffer); i++ {
-		nf = append(nf, i)
-	}
-	f.file = append(f.file[:line], append(nf, f.file[line:]...)...)
+	f.file.Insert(line, first, len(nlines))
 	f.Touch()
 	f.addr = line + len(nlines) - 1
 	return
 }
 
+// Move moves a range of lines so they're inserted at line
+// Unlike a Delete followed by an Insert, the lines keep their marks.
+func (f *FileBuffer) Move(r [2]int, line int) (e error) {
+	if f.OOB(r[0]) || f.OOB(r[1]) || r[0] > r[1] {
+		return ErrOOB
+	}
+	if line != f.Len() && f.OOB(line) {
+		return ErrOOB
+	}
+	if line > r[0] && line <= r[1] {
+		return fmt.Errorf("cannot move lines to within their own range")
+	}
+	n := r[1] - r[0] + 1
+	f.file.Move(r[0], n, line)
+	f.Touch()
+	f.addr = line + n - 1
+	if line > r[1] {
+		f.addr = line - 1
+	}
+	return
+}
+
+// Lines returns every line in the file, without moving the current line pointer
+func (f *FileBuffer) Lines() (lines []string) {
+	lines = make([]string, 0, f.Len())
+	for l := 0; l < f.Len(); l++ {
+		lines = append(lines, f.GetMust(l, false))
+	}
+	return
+}
+
 // Len returns the current file length
 func (f *FileBuffer) Len() int {
-	return len(f.file)
+	return f.file.Len()
 }
 
 // Dirty returns whether the file has changed
@@ -168,19 +203,44 @@ func (f *FileBuffer) SetAddr(i int) (e error) {
 }
 
 // Clean resets the dirty flag
+// Every other state in the undo tree now differs from what was saved, so they become dirty.
 func (f *FileBuffer) Clean() {
 	f.dirty = false
-	f.lastDirty = false
-	f.lastFile = []int{}
-	f.lastAddr = 0
+	for _, n := range f.tree {
+		n.state.dirty = n != f.undo
+	}
 }
 
 // FileToBuffer reads a file and creates a new FileBuffer from it
+// The FileBuffer remembers what the file looked like, so it can tell if it is changed by someone else.
 func FileToBuffer(file string) (fb *FileBuffer, e error) {
+	var fh *os.File
+	if fh, e = os.Open(file); e != nil {
+		e = fmt.Errorf("could not read file: %v", e)
+		return
+	}
+	defer fh.Close()
+	var fi os.FileInfo
+	if fi, e = fh.Stat(); e != nil {
+		return
+	}
+	h := sha256.New()
+	fb = NewFileBuffer(nil)
+	if e = fb.Read(0, io.TeeReader(fh, h)); e == nil {
+		fb.dirty = false
+		fb.mod = false
+		fb.disk = newFileStamp(file, fi, h)
+	}
+	return
+}
+
+// ReaderToBuffer reads from an io.Reader and creates a new FileBuffer from it
+func ReaderToBuffer(r io.Reader) (fb *FileBuffer, e error) {
 	fb = NewFileBuffer(nil)
-	e = fb.ReadFile(0, file)
+	e = fb.Read(0, r)
 	if e == nil {
 		fb.dirty = false
+		fb.mod = false
 	}
 	return
 }
@@ -191,7 +251,7 @@ func (f *FileBuffer) SetMark(c byte, l int) (e error) {
 		e = ErrOOB
 		return
 	}
-	f.marks[c] = f.file[l]
+	f.marks[c] = f.file.At(l)
 	return
 }
 
@@ -201,73 +261,194 @@ func (f *FileBuffer) GetMark(c byte) (l int, e error) {
 	if !ok {
 		return -1, fmt.Errorf("no such mark: %c", c)
 	}
-	for i := 0; i < f.Len(); i++ {
-		if f.file[i] == bl {
-			l = i
+	if l, ok = f.lineOf(bl); !ok {
+		return -1, fmt.Errorf("mark was cleared: %c", c)
+	}
+	return
+}
+
+// GlobalMark marks a line to be visited by a global command
+func (f *FileBuffer) GlobalMark(l int) (e error) {
+	if f.OOB(l) {
+		return ErrOOB
+	}
+	f.gmarks = append(f.gmarks, f.file.At(l))
+	return
+}
+
+// GlobalNext unmarks and returns the next globally marked line
+// Marked lines that have since been deleted are skipped; ok is false once no marks remain.
+func (f *FileBuffer) GlobalNext() (l int, ok bool) {
+	for len(f.gmarks) > 0 {
+		bl := f.gmarks[0]
+		f.gmarks = f.gmarks[1:]
+		if l, ok = f.lineOf(bl); ok {
 			return
 		}
 	}
-	return -1, fmt.Errorf("mark was cleared: %c", c)
+	return -1, false
 }
 
-// Size return the size (in bytes) of the current file buffer
+// GlobalClear removes all global command marks
+func (f *FileBuffer) GlobalClear() {
+	f.gmarks = nil
+}
+
+// lineOf finds the current line of a buffer line, ok is false if it's not in the file
+func (f *FileBuffer) lineOf(bl int) (l int, ok bool) {
+	return f.file.Line(bl)
+}
+
+// Size return the size (in bytes) of the current file buffer, as it would be written
 func (f *FileBuffer) Size() (s int) {
-	for _, i := range f.file {
-		s += len(f.buffer[i])
+	eol := len(f.eol())
+	for _, p := range f.file.Pieces() {
+		for i := p.start; i < p.start+p.count; i++ {
+			s += len(f.buffer[i]) + eol
+		}
+	}
+	if f.noEOL && f.Len() > 0 {
+		s -= eol
 	}
 	return
 }
 
 // Read reads in from an io.Reader interface and inserts at the current line address
+// If every line ends in \r\n the line endings are stripped, and an empty buffer will use them from now on.
+// Reading at the end of the buffer decides whether the last line has a line ending.
 func (f *FileBuffer) Read(line int, r io.Reader) (e error) {
 	b := []string{}
-	s := bufio.NewScanner(r)
+	cr := []int{} // lines that ended in \r\n
+	eol := true
+	s := newLineReader(r)
 	for s.Scan() {
+		if s.cr {
+			cr = append(cr, len(b))
+		}
 		b = append(b, s.Text())
+		eol = s.nl
+	}
+	if e = s.Err(); e != nil {
+		return fmt.Errorf("could not read: %v", e)
+	}
+	ended := len(b)
+	if !eol {
+		ended--
+	}
+	crlf := len(cr) > 0 && len(cr) == ended
+	if f.Len() == 0 {
+		f.crlf = crlf
+	}
+	if !crlf || !f.crlf {
+		// the \r is part of the line
+		for _, i := range cr {
+			b[i] += "\r"
+		}
+	}
+	end := line == f.Len()
+	if e = f.Insert(line, b); e != nil {
+		return
+	}
+	f.nlAdded = !eol
+	if end && len(b) > 0 {
+		f.noEOL = !eol
 	}
-	e = f.Insert(line, b)
 	return
 }
 
-// ReadFile reads in a file and inserts it at the current line address
-func (f *FileBuffer) ReadFile(line int, file string) (e error) {
-	var fh *os.File
-	if fh, e = os.Open(file); e != nil {
-		e = fmt.Errorf("could not read file: %v", e)
+// Write writes a line range to an io.Writer using the buffer's line endings
+func (f *FileBuffer) Write(r [2]int, w io.Writer) (n int, e error) {
+	var rd io.Reader
+	if rd, e = f.Reader(r); e != nil {
 		return
 	}
-	defer fh.Close()
+	var c int64
+	c, e = io.Copy(w, rd)
+	return int(c), e
+}
+
+// Reader returns an io.Reader that reads a line range using the buffer's line endings.
+// It reads the lines as they are now, so it can go on being read while the buffer changes.
+func (f *FileBuffer) Reader(r [2]int) (rd io.Reader, e error) {
+	lr := &linesReader{eol: f.eol()}
+	if f.Len() == 0 {
+		// nothing to read, and no valid range to read it from
+		return lr, nil
+	}
+	if lr.lines, e = f.Get(r); e != nil {
+		return
+	}
+	lr.noEOL = f.noEOL && r[1] == f.Len()-1
+	return lr, nil
+}
+
+// A linesReader reads lines, adding their line endings
+type linesReader struct {
+	lines []string
+	eol   string
+	noEOL bool   // the last line has no line ending
+	cur   string // what's left of the line being read
+}
 
-	f.Read(line, fh)
+func (l *linesReader) Read(p []byte) (n int, e error) {
+	for n < len(p) {
+		if len(l.cur) == 0 {
+			if len(l.lines) == 0 {
+				return n, io.EOF
+			}
+			l.cur = l.lines[0]
+			if len(l.lines) > 1 || !l.noEOL {
+				l.cur += l.eol
+			}
+			l.lines = l.lines[1:]
+		}
+		c := copy(p[n:], l.cur)
+		l.cur = l.cur[c:]
+		n += c
+	}
 	return
 }
 
-// Start a transaction
-func (f *FileBuffer) Start() {
-	f.mod = false
-	f.tmpFile = make([]int, len(f.file))
-	copy(f.tmpFile, f.file)
-	f.tmpAddr = f.addr
-	f.tmpDirty = f.dirty
+// NewlineAppended returns whether the last Read had to add a line ending to its last line
+func (f *FileBuffer) NewlineAppended() bool {
+	return f.nlAdded
+}
+
+// LineEnding returns the line ending style of the buffer: whether lines end in \r\n,
+// and whether the last line has a line ending
+func (f *FileBuffer) LineEnding() (crlf, eol bool) {
+	return f.crlf, !f.noEOL
 }
 
-// End a transaction
-func (f *FileBuffer) End() {
-	if f.mod {
-		f.lastFile = f.tmpFile
-		f.lastAddr = f.tmpAddr
-		f.lastDirty = f.tmpDirty
+// SetLineEnding converts the buffer to a new line ending style
+func (f *FileBuffer) SetLineEnding(crlf, eol bool) {
+	if crlf == f.crlf && eol == !f.noEOL {
+		return
 	}
+	f.crlf = crlf
+	f.noEOL = !eol
+	f.Touch()
 }
 
-// Rewind restores the previous file
-func (f *FileBuffer) Rewind() {
-	if f.Dirty() || f.lastDirty {
-		f.addr = f.lastAddr
-		f.file = f.lastFile
-		f.dirty = f.lastDirty
-		f.mod = true
+// eol is the line ending used by the buffer
+func (f *FileBuffer) eol() string {
+	if f.crlf {
+		return "\r\n"
+	}
+	return "\n"
+}
+
+// ReadFile reads in a file and inserts it at the current line address
+func (f *FileBuffer) ReadFile(line int, file string) (e error) {
+	var fh *os.File
+	if fh, e = os.Open(file); e != nil {
+		e = fmt.Errorf("could not read file: %v", e)
+		return
 	}
+	defer fh.Close()
+
+	e = f.Read(line, fh)
+	return
 }
 
 // Touch is the correct way (even internally) to set the dirty & modified bits
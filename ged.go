@@ -1,116 +1,435 @@
-// ged.go - main entry point for ged
-package main
+// ged.go - defines the Editor, the entry point for using ged as a package
+package ged
 
 import (
-	"bufio"
-	"flag"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 )
 
-// flags
-var (
-	fSuppress = flag.Bool("s", false, "suppress counts")
-	fPrompt   = flag.String("p", "*", "specify a command prompt")
-	fLoose    = flag.Bool("l", false, "loose exit mode, don't return errors for command failure (not implemented)")
-	fRestrict = flag.Bool("r", false, "no editing outside directory, no command exec (not implemented)")
+// Exit statuses, as returned by Editor.Run
+const (
+	ExitOK    = 0 // all commands succeeded, or we're in loose mode
+	ExitError = 1 // a command failed, or we couldn't start
+	ExitDirty = 2 // input ended with unsaved changes
 )
 
-// current FileBuffer
-var buffer *FileBuffer
+// ErrQuit is returned by Exec when a command quits the editor
+var ErrQuit = fmt.Errorf("quit")
 
-// current ed state
-var state struct {
-	fileName string // current filename
-	lastErr  error
-	printErr bool
-	prompt   bool
-	winSize  int
-	lastRep  string
-	lastSub  string
+// An Editor is an instance of ged editing a FileBuffer.
+// Commands and input text are read from an io.Reader, and output is written to an io.Writer.
+// The exported fields are options, and can be changed at any time.
+type Editor struct {
+	Suppress   bool      // suppress counts and diagnostics
+	Prompt     string    // command prompt
+	ShowPrompt bool      // show the prompt (toggled by P)
+	Loose      bool      // loose exit mode, don't return errors for command failure
+	Restrict   bool      // no editing outside directory, no command exec
+	History    int       // maximum depth of the undo history (0 is unlimited)
+	Backup     bool      // keep the old file as file~ when writing
+	Swap       bool      // keep a swap journal of changes to the file, see Recover
+	Extended   bool      // regular expressions are POSIX extended (ERE) rather than basic (BRE)
+	ShellStdin io.Reader // stdin for shell commands, nil for none
+	Stderr     io.Writer // diagnostics and shell command errors
+
+	ShellTimeout   time.Duration // kill shell commands that run for longer than this (0 is no limit)
+	ShellMaxOutput int64         // fail commands that write more than this many bytes to read into the buffer (0 is no limit)
+	ShellStderr    bool          // read shell commands' errors into the buffer along with their output
+
+	buffer    *FileBuffer   // current FileBuffer
+	buffers   []*openBuffer // every open buffer, in order, including the current one (see buffers.go)
+	cur       *openBuffer   // the current buffer's place in buffers
+	input     lineScanner   // where commands and input lines are read from
+	term      *Terminal     // the terminal input is read from, if it's a Terminal (see SetTerminal)
+	out       io.Writer     // where output is written
+	fileName  string        // current filename
+	lastErr   error
+	printErr  bool
+	winSize   int // lines to scroll with z
+	winCols   int // width of the window, for folding l
+	lastRep   string
+	lastSub   string
+	lastGlob  string   // last interactive global command list
+	lastShell string   // last shell command, for !!
+	re        *regexps // shared with the buffer, so addresses, s and g all use the same last regexp
+	regs      registers
+	inGlobal  bool   // are we running a global command list?
+	failed    bool   // has any command failed?
+	warned    string // a command refused with a warning, repeating it forces it
+	force     bool   // is the current command being repeated after a warning?
+	swap      *os.File
+
+	done chan struct{} // closed to interrupt the current command
+
+	mu     sync.Mutex  // guards saved, buffers, intr, idle and resize
+	saved  *checkpoint // unsaved changes as of the last command, for Hangup
+	intr   func()      // interrupts the current command, nil if there isn't one
+	idle   bool        // are we waiting for a command? (see scan)
+	resize [2]int      // a new winSize and winCols from SetWindowSize, 0 if unchanged
 }
 
-// Parse input and run command
-func run(cmd string) (e error) {
-	ctx := &Context{
-		cmd: cmd,
+// NewEditor creates a new Editor with an empty buffer
+func NewEditor(in io.Reader, out io.Writer) *Editor {
+	ed := &Editor{
+		Prompt:  "*",
+		Stderr:  out,
+		buffer:  NewFileBuffer(nil),
+		re:      &regexps{},
+		input:   newLineReader(in),
+		out:     out,
+		winSize: 22, // the size of a 24x80 terminal, until we're told otherwise (see SetWindowSize)
+		winCols: 72,
 	}
-	if ctx.addrs, ctx.cmdOffset, e = buffer.ResolveAddrs(cmd); e != nil {
+	ed.cur = &openBuffer{id: 1, buffer: ed.buffer}
+	ed.buffers = []*openBuffer{ed.cur}
+	return ed
+}
+
+// SetTerminal reads commands and input text from a Terminal, instead of the io.Reader given to NewEditor
+func (ed *Editor) SetTerminal(t *Terminal) {
+	ed.input = t
+	ed.term = t
+}
+
+// Buffer returns the current FileBuffer
+func (ed *Editor) Buffer() *FileBuffer {
+	return ed.buffer
+}
+
+// FileName returns the current file name
+func (ed *Editor) FileName() string {
+	return ed.fileName
+}
+
+// Load sets the current file name and reads the file into a new buffer.
+// A file that doesn't exist is not an error, we just start with an empty buffer.
+func (ed *Editor) Load(file string) (e error) {
+	if e = ed.restrictFile(file); e != nil {
 		return
 	}
-	if len(cmd) <= ctx.cmdOffset {
-		// no command, default to print
-		ctx.cmd += "p"
+	ed.fileName = file
+	if _, e = os.Stat(file); os.IsNotExist(e) {
+		if !ed.Suppress {
+			fmt.Fprintf(ed.Stderr, "%s: No such file or directory\n", file)
+		}
+		ed.openSwap(false)
+		return nil
 	}
-	if exe, ok := cmds[ctx.cmd[ctx.cmdOffset]]; ok {
-		buffer.Start()
-		if e = exe(ctx); e != nil {
-			return
+	var b *FileBuffer
+	if b, e = FileToBuffer(file); e != nil {
+		return
+	}
+	ed.buffer = b
+	if ed.buffer.NewlineAppended() && !ed.Suppress {
+		fmt.Fprintln(ed.Stderr, "Newline appended")
+	}
+	if !ed.Suppress {
+		fmt.Fprintln(ed.out, ed.buffer.Size())
+	}
+	ed.openSwap(false)
+	return
+}
+
+// Recover sets the current file name and replays its swap journal into a new buffer,
+// to get back changes that were lost when ged crashed.
+// The swap journal is replaced by a new one if Swap is set.
+func (ed *Editor) Recover(file string) (e error) {
+	if e = ed.restrictFile(file); e != nil {
+		return
+	}
+	var fh *os.File
+	if fh, e = os.Open(SwapFile(file)); e != nil {
+		return fmt.Errorf("could not recover file: %v", e)
+	}
+	defer fh.Close()
+	var b *FileBuffer
+	if b, e = JournalToBuffer(fh); e != nil {
+		return
+	}
+	ed.fileName = file
+	ed.buffer = b
+	ed.checkpoint()
+	if !ed.Suppress {
+		fmt.Fprintln(ed.out, ed.buffer.Size())
+	}
+	ed.openSwap(true)
+	return
+}
+
+// Hangup writes the buffer to ed.hup if it has unsaved changes, as ed does when it's hung up on.
+// Other buffers with unsaved changes are written to ed.hup.n, where n is the buffer's number.
+// If they can't be written in the current directory, they're written in the home directory.
+// Hangup can be called while another goroutine is running commands, the buffers are written as
+// they were after the last command finished.
+func (ed *Editor) Hangup() (e error) {
+	ed.mu.Lock()
+	saved := map[string]*checkpoint{"ed.hup": ed.saved}
+	for _, b := range ed.buffers {
+		if b != ed.cur {
+			saved[fmt.Sprintf("ed.hup.%d", b.id)] = b.saved
+		}
+	}
+	ed.mu.Unlock()
+	for name, c := range saved {
+		if err := hangup(c, name); err != nil && e == nil {
+			e = err
 		}
-		buffer.End()
-	} else {
-		return fmt.Errorf("invalid command: %v", cmd[ctx.cmdOffset])
 	}
 	return
 }
 
-// Entry point
-func main() {
-	var e error
-	flag.Usage = func() {
-		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [-s] [-p <prompt>] [file]\n", os.Args[0])
-		flag.PrintDefaults()
+// hangup writes a checkpoint to a file for Hangup
+func hangup(c *checkpoint, name string) (e error) {
+	if c == nil {
+		return
+	}
+	b := c.FileBuffer()
+	r := [2]int{0, b.Len() - 1}
+	if _, e = b.writeDirect(r, name); e == nil {
+		return
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		_, e = b.writeDirect(r, filepath.Join(home, name))
+	}
+	return
+}
+
+// Interrupt stops the command that is running, and undoes anything it did.
+// It's meant to be called from another goroutine, e.g. on SIGINT.  If Run is waiting for a command it prints ?,
+// as GNU Ed does, otherwise if no command is running it does nothing.
+func (ed *Editor) Interrupt() {
+	ed.mu.Lock()
+	defer ed.mu.Unlock()
+	if ed.intr != nil {
+		ed.intr()
+		ed.intr = nil
+	} else if ed.idle {
+		// Run won't write anything until it has a command, and takes the lock first
+		fmt.Fprintln(ed.out, "\n?")
+		ed.lastErr = ErrInterrupt
+		if ed.ShowPrompt {
+			fmt.Fprintf(ed.out, "%s", ed.Prompt)
+		}
 	}
-	flag.Parse()
-	flag.Visit(func(f *flag.Flag) {
-		if f.Name == "p" {
-			state.prompt = true
+}
+
+// interruptible lets the command we're about to run be interrupted
+func (ed *Editor) interruptible() {
+	done := make(chan struct{})
+	ed.done = done
+	ed.buffer.SetInterrupt(done)
+	ed.mu.Lock()
+	ed.intr = func() { close(done) }
+	ed.mu.Unlock()
+}
+
+// uninterruptible stops Interrupt from affecting a command that has finished
+func (ed *Editor) uninterruptible() {
+	ed.mu.Lock()
+	ed.intr = nil
+	ed.mu.Unlock()
+}
+
+// Close stops the swap journals of every buffer and removes them.
+// Call it when the editor is done with normally, swap journals are only needed after a crash.
+func (ed *Editor) Close() (e error) {
+	e = ed.closeSwap()
+	for _, b := range ed.buffers {
+		if b == ed.cur {
+			continue
 		}
-	})
-	args := flag.Args()
-	if len(args) > 1 { // we only accept one additional argument
-		flag.Usage()
-		os.Exit(1)
-	}
-	buffer = NewFileBuffer(nil)
-	if len(args) == 1 { // we were given a file name
-		state.fileName = args[0]
-		// try to read in the file
-		if _, e = os.Stat(state.fileName); os.IsNotExist(e) && !*fSuppress {
-			fmt.Fprintf(os.Stderr, "%s: No such file or directory", state.fileName)
-			// this is not fatal, we just start with an empty buffer
-		} else {
-			if buffer, e = FileToBuffer(state.fileName); e != nil {
-				fmt.Fprintln(os.Stderr, e)
-				os.Exit(1)
-			}
-			if !*fSuppress {
-				fmt.Println(buffer.Size())
-			}
+		if err := removeSwap(b.buffer, b.swap); e == nil {
+			e = err
 		}
+		b.swap = nil
+	}
+	return
+}
+
+// closeSwap stops the current buffer's swap journal and removes it
+func (ed *Editor) closeSwap() (e error) {
+	e = removeSwap(ed.buffer, ed.swap)
+	ed.swap = nil
+	return
+}
+
+// removeSwap stops a buffer's swap journal and removes it
+func removeSwap(b *FileBuffer, swap *os.File) (e error) {
+	b.Journal(nil)
+	if swap == nil {
+		return
+	}
+	e = swap.Close()
+	if err := os.Remove(swap.Name()); e == nil {
+		e = err
+	}
+	return
+}
+
+// openSwap starts a swap journal for the current buffer, if Swap is set
+// If a swap journal already exists it belongs to a session that crashed, so we leave it alone unless replace is set.
+func (ed *Editor) openSwap(replace bool) {
+	ed.closeSwap()
+	if !ed.Swap || ed.fileName == "" {
+		return
+	}
+	name := SwapFile(ed.fileName)
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if replace {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	fh, e := os.OpenFile(name, flags, 0600)
+	if os.IsExist(e) {
+		fmt.Fprintf(ed.Stderr, "%s: swap journal exists, not keeping one (recover it with -R)\n", name)
+		return
+	} else if e != nil {
+		fmt.Fprintf(ed.Stderr, "%s: could not create swap journal: %v\n", name, e)
+		return
 	}
-	state.winSize = 22 // we don't actually support getting the real window size
-	inScan := bufio.NewScanner(os.Stdin)
-	if state.prompt {
-		fmt.Printf("%s", *fPrompt)
-	}
-	for inScan.Scan() {
-		cmd := inScan.Text()
-		e = run(cmd)
-		if e != nil {
-			state.lastErr = e
-			if !*fSuppress && state.printErr {
-				fmt.Println(e)
+	ed.swap = fh
+	if e = ed.buffer.Journal(fh); e != nil {
+		fmt.Fprintf(ed.Stderr, "%s: could not write swap journal: %v\n", name, e)
+		ed.closeSwap()
+	}
+}
+
+// checkpoint records the buffer's unsaved changes for Hangup
+func (ed *Editor) checkpoint() {
+	ed.mu.Lock()
+	ed.saved = ed.buffer.checkpoint()
+	ed.mu.Unlock()
+}
+
+// Exec parses and runs a command as a single transaction
+func (ed *Editor) Exec(cmd string) (e error) {
+	ed.resized()
+	ed.force = cmd == ed.warned
+	ed.warned = ""
+	ed.buffer.SetHistory(ed.History)
+	ed.re.extended = ed.Extended
+	ed.buffer.re = ed.re
+	ed.interruptible()
+	defer ed.uninterruptible()
+	// the command may switch to another buffer, but the transaction is in this one
+	b := ed.buffer
+	b.Start()
+	e = ed.execute(cmd)
+	if e == ErrInterrupt {
+		b.Cancel()
+	}
+	b.End()
+	ed.checkpoint()
+	if err := ed.buffer.JournalErr(); err != nil && e == nil {
+		e = fmt.Errorf("swap journal stopped: %v", err)
+	}
+	if e != nil && e != ErrQuit {
+		ed.failed = true
+		ed.lastErr = e
+	}
+	return
+}
+
+// Run reads and executes commands until the input ends or a command quits.
+// It returns the exit status ged should use, and any error reading the input.
+func (ed *Editor) Run() (status int, e error) {
+	ed.prompt()
+	for ed.scan() {
+		if e = ed.Exec(ed.input.Text()); e == ErrQuit {
+			return ed.status(), nil
+		} else if e != nil {
+			if !ed.Suppress && ed.printErr {
+				fmt.Fprintln(ed.out, e)
 			} else {
-				fmt.Println("?")
+				fmt.Fprintln(ed.out, "?")
 			}
 		}
-		if state.prompt {
-			fmt.Printf("%s", *fPrompt)
+		ed.prompt()
+	}
+	if e = ed.input.Err(); e != nil {
+		return ExitError, e
+	}
+	if ed.dirtyBuffer() != nil {
+		ed.lastErr = fmt.Errorf("warning: file modified")
+		fmt.Fprintln(ed.out, "?")
+		return ExitDirty, nil
+	}
+	return ed.status(), nil
+}
+
+// scan reads the next command, letting Interrupt know that it's waiting for one
+func (ed *Editor) scan() (ok bool) {
+	ed.mu.Lock()
+	ed.idle = true
+	ed.mu.Unlock()
+	ok = ed.input.Scan()
+	ed.mu.Lock()
+	ed.idle = false
+	ed.mu.Unlock()
+	return
+}
+
+// prompt shows the prompt, if it's on, before reading a command
+func (ed *Editor) prompt() {
+	if ed.term != nil {
+		p := ""
+		if ed.ShowPrompt {
+			p = ed.Prompt
+		}
+		ed.term.Command(p)
+		return
+	}
+	if ed.ShowPrompt {
+		fmt.Fprintf(ed.out, "%s", ed.Prompt)
+	}
+}
+
+// Parse input and run command without starting a transaction
+func (ed *Editor) execute(cmd string) (e error) {
+	ctx := &Context{
+		cmd: cmd,
+	}
+	if ctx.addrs, ctx.cmdOffset, e = ed.buffer.ResolveAddrs(cmd); e != nil {
+		return
+	}
+	// the offset counts leading whitespace, which isn't an address
+	ctx.addressed = ctx.cmdOffset > len(cmd)-len(strings.TrimLeft(cmd, " \t"))
+	if len(cmd) <= ctx.cmdOffset {
+		// no command, default to print
+		ctx.cmd += "p"
+	}
+	c := ctx.cmd[ctx.cmdOffset]
+	exe, ok := cmds[c]
+	if !ok {
+		return fmt.Errorf("invalid command: %v", c)
+	}
+	switch tail := ctx.cmd[ctx.cmdOffset+1:]; {
+	case strings.IndexByte(suffixOnly, c) >= 0:
+		if strings.IndexByte(registerCmds, c) >= 0 {
+			if ctx.reg, tail, e = parseRegister(tail, c != 'x'); e != nil {
+				return
+			}
+		}
+		if ctx.print, e = parseSuffix(tail); e != nil {
+			return
 		}
+	case strings.IndexByte(noSuffix, c) >= 0 && len(tail) > 0:
+		return ErrSuffix
+	}
+	if e = exe(ed, ctx); e == nil && ctx.print != 0 && ed.buffer.Len() > 0 {
+		e = ed.printLine(ed.buffer.GetAddr(), ctx.print)
 	}
-	if inScan.Err() != nil {
-		fmt.Fprintf(os.Stderr, "error reading stdin: %v", inScan.Err())
-		os.Exit(1)
+	return
+}
+
+// status is the exit status reflecting whether any commands failed
+func (ed *Editor) status() int {
+	if ed.failed && !ed.Loose {
+		return ExitError
 	}
+	return ExitOK
 }
@@ -1,6 +1,1196 @@
-package main
+package ged
 
-import "testing"
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
 
 func TestResolveAddr(t *testing.T) {
 }
+
+func TestGlobalMarks(t *testing.T) {
+	f := NewFileBuffer([]string{"a", "b", "c", "d"})
+	for _, l := range []int{1, 2, 3} {
+		if e := f.GlobalMark(l); e != nil {
+			t.Fatal(e)
+		}
+	}
+	// deleting a marked line should drop it from the global marks
+	if e := f.Delete([2]int{2, 2}); e != nil {
+		t.Fatal(e)
+	}
+	got := []int{}
+	for l, ok := f.GlobalNext(); ok; l, ok = f.GlobalNext() {
+		got = append(got, l)
+	}
+	if len(got) != 2 || got[0] != 1 || got[1] != 2 {
+		t.Errorf("expected marks [1 2], got %v", got)
+	}
+}
+
+func TestUndoRedo(t *testing.T) {
+	f := NewFileBuffer([]string{"a", "b", "c"})
+	for i := 0; i < 2; i++ {
+		f.Start()
+		f.Delete([2]int{0, 0})
+		f.End()
+	}
+	if e := f.Rewind(); e != nil || f.Len() != 2 {
+		t.Fatalf("expected 2 lines after undo, got %d (%v)", f.Len(), e)
+	}
+	if e := f.Rewind(); e != nil || f.Len() != 3 {
+		t.Fatalf("expected 3 lines after undo, got %d (%v)", f.Len(), e)
+	}
+	if e := f.Rewind(); e != ErrNoUndo {
+		t.Errorf("expected ErrNoUndo, got %v", e)
+	}
+	if e := f.Forward(); e != nil || f.Len() != 2 {
+		t.Fatalf("expected 2 lines after redo, got %d (%v)", f.Len(), e)
+	}
+	// the history counts undo steps back from the current state, the redo goes first
+	f.SetHistory(1)
+	if e := f.Rewind(); e != nil {
+		t.Fatal(e)
+	}
+	if e := f.Rewind(); e != ErrNoUndo {
+		t.Errorf("expected history depth of 1, got %v", e)
+	}
+}
+
+func TestUndoTree(t *testing.T) {
+	f := NewFileBuffer([]string{"a", "b", "c"})
+	f.Start()
+	f.Delete([2]int{0, 0})
+	f.End()
+	f.Rewind()
+	// a change after an undo starts a new branch
+	f.Start()
+	f.Delete([2]int{2, 2})
+	f.End()
+	tree := f.UndoTree()
+	if len(tree) != 3 || tree[1].Parent != 0 || tree[2].Parent != 0 || !tree[2].Current {
+		t.Fatalf("unexpected undo tree: %v", tree)
+	}
+	if e := f.UndoTo(1); e != nil {
+		t.Fatal(e)
+	}
+	if l := f.GetMust(0, false); l != "b" {
+		t.Errorf("expected first line b in state 1, got %s", l)
+	}
+	if e := f.Rewind(); e != nil || f.Len() != 3 {
+		t.Fatalf("expected 3 lines in the root state, got %d (%v)", f.Len(), e)
+	}
+	if e := f.Forward(); e != nil || f.GetMust(0, false) != "b" {
+		t.Errorf("expected redo to follow the branch we came from")
+	}
+	// with a depth of 1, the other branch goes before the one undo step we have
+	f.UndoTo(2)
+	f.SetHistory(1)
+	if tree := f.UndoTree(); len(tree) != 2 || tree[0].Seq != 0 || tree[1].Seq != 2 {
+		t.Fatalf("expected the branch to be pruned, got %v", tree)
+	}
+	if e := f.Rewind(); e != nil || f.Len() != 3 {
+		t.Fatalf("expected 3 lines after undo, got %d (%v)", f.Len(), e)
+	}
+}
+
+func TestEditors(t *testing.T) {
+	var out1, out2 bytes.Buffer
+	ed1 := NewEditor(strings.NewReader("one\n.\n"), &out1)
+	ed2 := NewEditor(strings.NewReader("two\n.\n"), &out2)
+	for _, ed := range []*Editor{ed1, ed2} {
+		for _, cmd := range []string{"a", "p"} {
+			if e := ed.Exec(cmd); e != nil {
+				t.Fatalf("%s: %v", cmd, e)
+			}
+		}
+	}
+	if out1.String() != "one\n" || out2.String() != "two\n" {
+		t.Errorf("editors interfered with each other: %q, %q", out1.String(), out2.String())
+	}
+	if e := ed1.Exec("q"); e == nil || e == ErrQuit {
+		t.Errorf("expected q to fail with a modified buffer, got %v", e)
+	}
+	if e := ed1.Exec("Q"); e != ErrQuit {
+		t.Errorf("expected ErrQuit, got %v", e)
+	}
+	if ed2.Buffer().Len() != 1 {
+		t.Errorf("expected 1 line in buffer, got %d", ed2.Buffer().Len())
+	}
+}
+
+func TestRestrict(t *testing.T) {
+	dir, remove := tempDir(t, false)
+	defer remove()
+	out := filepath.Join(dir, "out")
+	var buf bytes.Buffer
+	ed := NewEditor(strings.NewReader("a\nb\n.\n"), &buf)
+	ed.Restrict = true
+	if e := ed.Load(filepath.Join(dir, "in")); e != ErrRestrictFile {
+		t.Errorf("expected loading a path to be refused, got %v", e)
+	}
+	// e first, while the buffer is unmodified
+	for _, cmd := range []string{"e !ls", "e ../in", "e " + out, "E ../in"} {
+		if e := ed.Exec(cmd); e != ErrRestrictShell && e != ErrRestrictFile {
+			t.Errorf("%s: expected restricted mode to refuse it, got %v", cmd, e)
+		}
+	}
+	if e := ed.Exec("a"); e != nil {
+		t.Fatal(e)
+	}
+	for _, c := range []struct {
+		cmd string
+		exp error
+	}{
+		{"!ls", ErrRestrictShell},
+		{"!!", ErrRestrictShell},
+		{"r !ls", ErrRestrictShell},
+		{"w !cat", ErrRestrictShell},
+		{"1,2!sort", ErrRestrictShell},
+		{" 1!sort", ErrRestrictShell},
+		{"g/a/!ls", ErrRestrictShell},
+		{"r ../in", ErrRestrictFile},
+		{"w " + out, ErrRestrictFile},
+		{"w ..out", ErrRestrictFile},
+		{"wq " + out, ErrRestrictFile},
+		{"W " + out, ErrRestrictFile},
+		{"f " + out, ErrRestrictFile},
+		{"f sub/out", ErrRestrictFile},
+		{"B ../in", ErrRestrictFile},
+		{"C " + out, ErrRestrictFile},
+	} {
+		if e := ed.Exec(c.cmd); e != c.exp {
+			t.Errorf("%s: expected %v, got %v", c.cmd, c.exp, e)
+		}
+	}
+	if _, e := os.Stat(out); !os.IsNotExist(e) {
+		t.Errorf("expected nothing to be written outside the directory, got %v", e)
+	}
+	if s := strings.Join(ed.Buffer().Lines(), ","); s != "a,b" || ed.FileName() != "" {
+		t.Errorf("expected the buffer and file name to be unchanged, got %s and %q", s, ed.FileName())
+	}
+	// h explains why the last command was refused
+	ed.Exec("!ls")
+	buf.Reset()
+	if e := ed.Exec("h"); e != nil {
+		t.Fatal(e)
+	}
+	if exp := ErrRestrictShell.Error() + "\n"; buf.String() != exp {
+		t.Errorf("expected h to print %q, got %q", exp, buf.String())
+	}
+	// a file in the current directory is fine
+	if e := ed.Exec("f out.txt"); e != nil || ed.FileName() != "out.txt" {
+		t.Errorf("expected a plain file name to be allowed, got %v", e)
+	}
+}
+
+func TestRunStatus(t *testing.T) {
+	for _, c := range []struct {
+		in     string
+		loose  bool
+		status int
+		out    string
+	}{
+		{"a\nx\n.\nQ\n", false, ExitOK, ""},
+		{"1p\nQ\n", false, ExitError, "?\n"},
+		{"1p\nQ\n", true, ExitOK, "?\n"},
+		{"1p\n", false, ExitError, "?\n"},
+		{"1p\n", true, ExitOK, "?\n"},
+		{"a\nx\n.\nq\nQ\n", false, ExitError, "?\n"},
+		{"a\nx\n.\n", false, ExitDirty, "?\n"},
+		{"a\nx\n.\n", true, ExitDirty, "?\n"},
+	} {
+		var out bytes.Buffer
+		ed := NewEditor(strings.NewReader(c.in), &out)
+		ed.Suppress = true
+		ed.Loose = c.loose
+		status, e := ed.Run()
+		if e != nil {
+			t.Fatalf("%q: %v", c.in, e)
+		}
+		if status != c.status || out.String() != c.out {
+			t.Errorf("%q (loose %v): expected status %d and %q, got %d and %q", c.in, c.loose, c.status, c.out, status, out.String())
+		}
+	}
+}
+
+func TestLineMap(t *testing.T) {
+	// compare a lineMap to a plain slice over a sequence of random edits
+	var m lineMap
+	model := []int{}
+	next := 0
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		switch op := rng.Intn(3); {
+		case op == 0 || len(model) == 0:
+			l, n := rng.Intn(len(model)+1), rng.Intn(5)+1
+			m.Insert(l, next, n)
+			ins := []int{}
+			for j := 0; j < n; j++ {
+				ins = append(ins, next+j)
+			}
+			next += n
+			model = append(model[:l], append(ins, model[l:]...)...)
+		case op == 1:
+			l := rng.Intn(len(model))
+			n := rng.Intn(len(model)-l) + 1
+			m.Delete(l, n)
+			model = append(model[:l], model[l+n:]...)
+		default:
+			l := rng.Intn(len(model))
+			n := rng.Intn(len(model)-l) + 1
+			dest := rng.Intn(len(model) + 1)
+			if dest > l && dest <= l+n {
+				continue
+			}
+			m.Move(l, n, dest)
+			moved := append([]int{}, model[l:l+n]...)
+			rest := append(append([]int{}, model[:l]...), model[l+n:]...)
+			if dest > l {
+				dest -= n
+			}
+			model = append(rest[:dest], append(moved, rest[dest:]...)...)
+		}
+		if m.Len() != len(model) {
+			t.Fatalf("step %d: expected %d lines, got %d", i, len(model), m.Len())
+		}
+		for l, b := range model {
+			if m.At(l) != b {
+				t.Fatalf("step %d: expected buffer line %d at %d, got %d", i, b, l, m.At(l))
+			}
+			if ml, ok := m.Line(b); !ok || ml != l {
+				t.Fatalf("step %d: expected buffer line %d to be at %d, got %d", i, b, l, ml)
+			}
+		}
+	}
+}
+
+// testEditor creates an Editor writing to out, without counts, and appends lines to its buffer as its first change
+func testEditor(t *testing.T, out io.Writer, lines ...string) *Editor {
+	t.Helper()
+	ed := NewEditor(strings.NewReader(strings.Join(append(lines, "."), "\n")+"\n"), out)
+	ed.Suppress = true
+	if len(lines) > 0 {
+		if e := ed.Exec("a"); e != nil {
+			t.Fatal(e)
+		}
+	}
+	return ed
+}
+
+// execAll runs commands in order, stopping the test at the first that fails
+func execAll(t *testing.T, ed *Editor, cmds ...string) {
+	t.Helper()
+	for _, cmd := range cmds {
+		if e := ed.Exec(cmd); e != nil {
+			t.Fatalf("%s: %v", cmd, e)
+		}
+	}
+}
+
+// checkLines checks the lines of the editor's current buffer, joined with commas
+func checkLines(t *testing.T, ed *Editor, exp string) {
+	t.Helper()
+	if s := strings.Join(ed.Buffer().Lines(), ","); s != exp {
+		t.Errorf("expected %s, got %s", exp, s)
+	}
+}
+
+// tempDir creates a directory for a test's files, and returns a function that removes it.
+// If cd is set, the test is run in the directory until it's removed.
+func tempDir(t *testing.T, cd bool) (dir string, remove func()) {
+	t.Helper()
+	dir, e := ioutil.TempDir("", "ged")
+	if e != nil {
+		t.Fatal(e)
+	}
+	remove = func() { os.RemoveAll(dir) }
+	if cd {
+		wd, _ := os.Getwd()
+		if e = os.Chdir(dir); e != nil {
+			remove()
+			t.Fatal(e)
+		}
+		remove = func() {
+			os.Chdir(wd)
+			os.RemoveAll(dir)
+		}
+	}
+	return
+}
+
+// needShell skips a test that runs shell commands if there's no shell
+func needShell(t *testing.T) {
+	t.Helper()
+	if _, e := os.Stat(shellpath); e != nil {
+		t.Skip("no shell: ", e)
+	}
+}
+
+// benchLines is about the size of a large log file
+const benchLines = 1 << 21
+
+func benchBuffer() *FileBuffer {
+	lines := make([]string, benchLines)
+	for i := range lines {
+		lines[i] = "a line of a large log file"
+	}
+	return NewFileBuffer(lines)
+}
+
+func BenchmarkDeleteAll(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		f := benchBuffer()
+		b.StartTimer()
+		f.Delete([2]int{0, f.Len() - 1})
+	}
+}
+
+func BenchmarkDeleteLines(b *testing.B) {
+	f := benchBuffer()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f.Delete([2]int{i % f.Len(), i % f.Len()})
+	}
+}
+
+func BenchmarkInsert(b *testing.B) {
+	f := benchBuffer()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f.Insert((i*7919)%f.Len(), []string{"inserted"})
+	}
+}
+
+func BenchmarkMove(b *testing.B) {
+	f := benchBuffer()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f.Move([2]int{0, benchLines/2 - 1}, f.Len())
+	}
+}
+
+func BenchmarkGetMark(b *testing.B) {
+	f := benchBuffer()
+	for i := 0; i < 1000; i++ {
+		f.Insert((i*7919)%f.Len(), []string{"inserted"})
+	}
+	f.SetMark('a', f.Len()-1)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, e := f.GetMark('a'); e != nil {
+			b.Fatal(e)
+		}
+	}
+}
+
+func TestLongLines(t *testing.T) {
+	long := strings.Repeat("x", 1<<20)
+	f := NewFileBuffer(nil)
+	if e := f.Read(0, strings.NewReader(long+"\n"+long)); e != nil {
+		t.Fatal(e)
+	}
+	if f.Len() != 2 || f.GetMust(0, false) != long || f.GetMust(1, false) != long {
+		t.Errorf("long lines were not read correctly")
+	}
+	var out bytes.Buffer
+	ed := NewEditor(strings.NewReader(long+"\n.\n"), &out)
+	if e := ed.Exec("a"); e != nil {
+		t.Fatal(e)
+	}
+	if e := ed.Exec("s/x*/&y/"); e != nil {
+		t.Fatal(e)
+	}
+	if l := ed.Buffer().GetMust(0, false); l != long+"y" {
+		t.Errorf("long input line was not read correctly, got %d bytes", len(l))
+	}
+}
+
+func TestLineEndings(t *testing.T) {
+	for _, in := range []string{"a\nb\n", "a\nb", "a\r\nb\r\n", "a\r\nb", "a\r\nb\n", "a\nb\r", "a\r\nb\r", "a\r\r\n", ""} {
+		f := NewFileBuffer(nil)
+		if e := f.Read(0, strings.NewReader(in)); e != nil {
+			t.Fatal(e)
+		}
+		var out bytes.Buffer
+		if _, e := f.Write([2]int{0, f.Len() - 1}, &out); e != nil {
+			t.Fatal(e)
+		}
+		if out.String() != in {
+			t.Errorf("expected %q to be written back unchanged, got %q", in, out.String())
+		}
+		if f.Size() != len(in) {
+			t.Errorf("expected size %d for %q, got %d", len(in), in, f.Size())
+		}
+	}
+	// a \r at the very end isn't a line ending, and survives being loaded and written back
+	dir, remove := tempDir(t, false)
+	defer remove()
+	name := filepath.Join(dir, "cr.txt")
+	ioutil.WriteFile(name, []byte("a\nb\r"), 0666)
+	ed := NewEditor(strings.NewReader(""), ioutil.Discard)
+	if e := ed.Load(name); e != nil {
+		t.Fatal(e)
+	}
+	if e := ed.Exec("w"); e != nil {
+		t.Fatal(e)
+	}
+	if b, _ := ioutil.ReadFile(name); string(b) != "a\nb\r" {
+		t.Errorf("expected \"a\\nb\\r\" to be written back unchanged, got %q", b)
+	}
+
+	f := NewFileBuffer(nil)
+	f.Read(0, strings.NewReader("a\r\nb"))
+	f.SetLineEnding(false, true)
+	var out bytes.Buffer
+	f.Write([2]int{0, 1}, &out)
+	if out.String() != "a\nb\n" {
+		t.Errorf("expected conversion to \"a\\nb\\n\", got %q", out.String())
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	dir, remove := tempDir(t, false)
+	defer remove()
+	real := filepath.Join(dir, "real")
+	link := filepath.Join(dir, "link")
+	if e := ioutil.WriteFile(real, []byte("a\nb\n"), 0640); e != nil {
+		t.Fatal(e)
+	}
+	if e := os.Symlink("real", link); e != nil {
+		t.Skip("no symlinks: ", e)
+	}
+	f, e := FileToBuffer(link)
+	if e != nil {
+		t.Fatal(e)
+	}
+	f.Delete([2]int{0, 0})
+	if _, e = f.WriteFile([2]int{0, f.Len() - 1}, link, true); e != nil {
+		t.Fatal(e)
+	}
+	if fi, e := os.Lstat(link); e != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("expected link to still be a symlink")
+	}
+	if fi, e := os.Stat(real); e != nil || fi.Mode().Perm() != 0640 {
+		t.Errorf("expected mode to be kept")
+	}
+	for file, content := range map[string]string{real: "b\n", real + "~": "a\nb\n"} {
+		if b, _ := ioutil.ReadFile(file); string(b) != content {
+			t.Errorf("expected %s to contain %q, got %q", file, content, string(b))
+		}
+	}
+	if tmps, _ := filepath.Glob(filepath.Join(dir, ".*")); len(tmps) > 0 {
+		t.Errorf("temporary files were left behind: %v", tmps)
+	}
+}
+
+func TestChanged(t *testing.T) {
+	dir, remove := tempDir(t, false)
+	defer remove()
+	file := filepath.Join(dir, "file")
+	e := ioutil.WriteFile(file, []byte("a\nb\n"), 0644)
+	if e != nil {
+		t.Fatal(e)
+	}
+	out := bytes.NewBuffer(nil)
+	ed := NewEditor(strings.NewReader(""), out)
+	ed.Suppress = true
+	if e = ed.Load(file); e != nil {
+		t.Fatal(e)
+	}
+	if e = ed.Exec("1d"); e != nil {
+		t.Fatal(e)
+	}
+	if e = ed.Exec("w"); e != nil {
+		t.Fatalf("unexpected warning writing an unchanged file: %v", e)
+	}
+	// the same size and time, but not the same content
+	fi, _ := os.Stat(file)
+	if e = ioutil.WriteFile(file, []byte("c\n"), 0644); e != nil {
+		t.Fatal(e)
+	}
+	os.Chtimes(file, fi.ModTime(), fi.ModTime())
+	if e = ed.Exec("w"); e == nil {
+		t.Fatal("expected a warning writing a changed file with the same size and time")
+	}
+	if e = ed.Exec("w"); e != nil {
+		t.Fatalf("expected repeating w to force it, got %v", e)
+	}
+	os.Chtimes(file, time.Now(), time.Now().Add(time.Minute))
+	if e = ed.Exec("C"); e != nil {
+		t.Fatal(e)
+	}
+	if out.String() != "" {
+		t.Errorf("expected no differences, got %q", out.String())
+	}
+	if e = ioutil.WriteFile(file, []byte("c\nb\nd\n"), 0644); e != nil {
+		t.Fatal(e)
+	}
+	if e = ed.Exec("C"); e != nil {
+		t.Fatal(e)
+	}
+	if exp := "1d0\n< c\n3d1\n< d\n"; out.String() != exp {
+		t.Errorf("expected diff %q, got %q", exp, out.String())
+	}
+	if e = ed.Exec("w"); e == nil {
+		t.Fatal("expected a warning writing a changed file")
+	}
+	if e = ed.Exec("w"); e != nil {
+		t.Fatalf("expected repeating w to force it, got %v", e)
+	}
+	if b, _ := ioutil.ReadFile(file); string(b) != "b\n" {
+		t.Errorf("expected the file to be written, got %q", string(b))
+	}
+}
+
+func TestDiff(t *testing.T) {
+	for _, c := range []struct{ a, b, exp string }{
+		{"", "", ""},
+		{"abc", "abc", ""},
+		{"", "ab", "0a1,2\n> a\n> b\n"},
+		{"abcabba", "cbabac", "1,2d0\n< a\n< b\n3a2\n> b\n6d4\n< b\n7a6\n> c\n"},
+		{"axc", "ayyc", "2c2,3\n< x\n---\n> y\n> y\n"},
+	} {
+		a, b := strings.Split(c.a, ""), strings.Split(c.b, "")
+		out := bytes.NewBuffer(nil)
+		writeDiff(out, a, b, diff(a, b))
+		if out.String() != c.exp {
+			t.Errorf("diff %q %q: expected %q, got %q", c.a, c.b, c.exp, out.String())
+		}
+	}
+}
+
+func TestJournal(t *testing.T) {
+	f := NewFileBuffer([]string{"a", "b", "c"})
+	j := bytes.NewBuffer(nil)
+	if e := f.Journal(j); e != nil {
+		t.Fatal(e)
+	}
+	for _, edit := range []func(){
+		func() { f.Delete([2]int{0, 0}) },
+		func() { f.Insert(1, []string{"x", "y"}) },
+		func() { f.Rewind() },
+		func() { f.Insert(0, []string{"z"}) },
+		func() { f.SetLineEnding(true, false) },
+	} {
+		f.Start()
+		edit()
+		f.End()
+	}
+	exp := f.Lines()
+	r, e := JournalToBuffer(bytes.NewReader(j.Bytes()))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if got := r.Lines(); strings.Join(got, "\n") != strings.Join(exp, "\n") {
+		t.Errorf("expected %q to be recovered, got %q", exp, got)
+	}
+	if crlf, eol := r.LineEnding(); !crlf || eol {
+		t.Errorf("expected line endings to be recovered")
+	}
+	if !r.Dirty() {
+		t.Errorf("expected the recovered buffer to be dirty")
+	}
+	// a crash part way through writing the last transaction loses only that transaction
+	if r, e = JournalToBuffer(bytes.NewReader(j.Bytes()[:j.Len()-3])); e != nil {
+		t.Fatal(e)
+	}
+	if crlf, _ := r.LineEnding(); crlf || r.Len() != 3 || r.GetMust(0, false) != "z" {
+		t.Errorf("expected the second to last state to be recovered, got %q", r.Lines())
+	}
+	if _, e = JournalToBuffer(bytes.NewReader(nil)); e == nil {
+		t.Errorf("expected an empty journal to fail")
+	}
+}
+
+func TestHangup(t *testing.T) {
+	_, remove := tempDir(t, true)
+	defer remove()
+	ed := NewEditor(strings.NewReader("a\nb\n.\n"), ioutil.Discard)
+	e := ed.Hangup()
+	if e != nil {
+		t.Fatal(e)
+	}
+	if _, e = os.Stat("ed.hup"); !os.IsNotExist(e) {
+		t.Errorf("expected a clean buffer not to be written")
+	}
+	ed.Exec("a")
+	ed.Exec("1d")
+	ed.Buffer().Start()
+	ed.Buffer().Insert(0, []string{"unfinished"})
+	if e = ed.Hangup(); e != nil {
+		t.Fatal(e)
+	}
+	if b, _ := ioutil.ReadFile("ed.hup"); string(b) != "b\n" {
+		t.Errorf("expected ed.hup to have the buffer as of the last command, got %q", string(b))
+	}
+
+	// hanging up while commands run, and while w marks the undo states clean, is safe (see go test -race)
+	ed = NewEditor(strings.NewReader("x\n.\n"), ioutil.Discard)
+	ed.Suppress = true
+	ed.Exec("f file")
+	ed.Exec("a")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			ed.Hangup()
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		ed.Exec("t.")
+		ed.Exec("w")
+		ed.Exec("u")
+	}
+	<-done
+}
+
+func TestInterrupt(t *testing.T) {
+	f := NewFileBuffer([]string{"a", "b", "c"})
+	done := make(chan struct{})
+	f.SetInterrupt(done)
+	f.Start()
+	f.Delete([2]int{0, 1})
+	if _, _, e := f.ResolveAddrs("/c/"); e != nil {
+		t.Fatal(e)
+	}
+	close(done)
+	if _, _, e := f.ResolveAddrs("/c/"); e != ErrInterrupt {
+		t.Fatalf("expected the search to be interrupted, got %v", e)
+	}
+	f.Cancel()
+	f.End()
+	if f.Len() != 3 || f.Dirty() {
+		t.Errorf("expected the transaction to be cancelled, got %q", f.Lines())
+	}
+	if f.Rewind() != ErrNoUndo {
+		t.Errorf("expected a cancelled transaction not to be undoable")
+	}
+
+	// an interrupted jump through the undo tree goes back to where it started in the tree too
+	f.Start()
+	f.Delete([2]int{0, 0})
+	f.End()
+	f.Start()
+	f.UndoTo(0)
+	f.Cancel()
+	f.End()
+	if tree := f.UndoTree(); f.Len() != 2 || !tree[len(tree)-1].Current {
+		t.Errorf("expected the jump to be cancelled, got %q and %v", f.Lines(), tree)
+	}
+	if e := f.Rewind(); e != nil || f.Len() != 3 {
+		t.Errorf("expected to undo from where we were before the jump, got %q (%v)", f.Lines(), e)
+	}
+
+	needShell(t)
+	ed := NewEditor(strings.NewReader(""), ioutil.Discard)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		ed.Interrupt()
+	}()
+	start := time.Now()
+	if e := ed.Exec("!sleep 10"); e != ErrInterrupt {
+		t.Errorf("expected the command to be interrupted, got %v", e)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("expected the command to be killed")
+	}
+
+	// at the prompt, an interrupt prints ?
+	r, w := io.Pipe()
+	var out bytes.Buffer
+	ed = NewEditor(r, &out)
+	status := make(chan int)
+	go func() {
+		s, _ := ed.Run()
+		status <- s
+	}()
+	for idle := false; !idle; {
+		time.Sleep(time.Millisecond)
+		ed.mu.Lock()
+		idle = ed.idle
+		ed.mu.Unlock()
+	}
+	ed.Interrupt()
+	io.WriteString(w, "h\n")
+	w.Close()
+	<-status
+	if exp := "\n?\n" + ErrInterrupt.Error() + "\n"; out.String() != exp {
+		t.Errorf("expected %q, got %q", exp, out.String())
+	}
+}
+
+func TestTranslateRE(t *testing.T) {
+	for _, c := range []struct {
+		pat      string
+		extended bool
+		match    string
+		exp      string // the longest leftmost match, or "-" for an invalid pattern
+	}{
+		{`\(ab\)*c`, false, "xababc", "ababc"},
+		{`(ab)`, false, "(ab)", "(ab)"},
+		{`a\{2,3\}`, false, "aaaa", "aaa"},
+		{`a\{,2\}b`, false, "aab", "aab"},
+		{`a{2}`, false, "a{2}", "a{2}"},
+		{`a+b?`, false, "a+b?", "a+b?"},
+		{`a\+`, false, "baaa", "aaa"},
+		{`*a`, false, "x*a", "*a"},
+		{`\(*a\)`, false, "*a", "*a"},
+		{`a^b$c`, false, "a^b$c", "a^b$c"},
+		{`^a$`, false, "a", "a"},
+		{`[[:alpha:]]*`, false, "ab1", "ab"},
+		{`[]a]*`, false, "]a]b", "]a]"},
+		{`[\]`, false, `a\`, `\`},
+		{`[^[:digit:]]`, false, "1a", "a"},
+		{`a**`, false, "aa", "aa"},
+		{`x\|y`, false, "y", "y"},
+		{`a|b`, false, "a|b", "a|b"},
+		{`\.`, false, "a.", "."},
+		{`é`, false, "café", "é"},
+		{`ï*`, false, "ïïx", "ïï"},
+		{`\(日本\)\{2\}`, false, "日本日本語", "日本日本"},
+		{`\é`, false, "é", "é"},
+		{`[é]x`, false, "éx", "éx"},
+		{`\(a`, false, "", "-"},
+		{`\(a\)\1`, false, "", "-"},
+		{`a\{x\}`, false, "", "-"},
+		{`(ab)+c`, true, "ababc", "ababc"},
+		{`\(a\)`, true, "(a)", "(a)"},
+		{`a{2}|b`, true, "aab", "aa"},
+		{`a|ab`, true, "ab", "ab"},
+		{`a{x}`, true, "a{x}", "a{x}"},
+		{`ï+`, true, "naïïve", "ïï"},
+		{`(é|è)s`, true, "ès", "ès"},
+		{`(a`, true, "", "-"},
+	} {
+		rx, e := compileRE(c.pat, c.extended)
+		if c.exp == "-" {
+			if e == nil {
+				t.Errorf("expected %q to be invalid", c.pat)
+			}
+			continue
+		}
+		if e != nil {
+			t.Errorf("%q: %v", c.pat, e)
+			continue
+		}
+		if m := rx.FindString(c.match); m != c.exp {
+			t.Errorf("%q in %q: expected to match %q, got %q", c.pat, c.match, c.exp, m)
+		}
+	}
+}
+
+func TestLastRegexp(t *testing.T) {
+	var out bytes.Buffer
+	ed := NewEditor(strings.NewReader("ab\ncd\nab\nef\n.\n"), &out)
+	if e := ed.Exec("//"); e != ErrNoRegexp {
+		t.Errorf("expected an empty pattern to fail before any other, got %v", e)
+	}
+	execAll(t, ed, "a", "1", "/a\\(b\\)/", "//", "??", "s//x\\1/", "g//p", "v//s/$/!/", "1,$p")
+	if exp := "ab\nab\nab\nab\nab\nab\ncd!\nxb!\nef!\n"; out.String() != exp {
+		t.Errorf("expected %q, got %q", exp, out.String())
+	}
+	if len(ed.re.cache) != 2 {
+		t.Errorf("expected 2 compiled regexps to be cached, got %d", len(ed.re.cache))
+	}
+}
+
+func TestList(t *testing.T) {
+	for _, c := range []struct {
+		line      string
+		cols, col int
+		exp       string
+	}{
+		{"a\tb$c\\", 72, 0, `a\tb\$c\\$`},
+		{"\a\b\f\r\v", 72, 0, `\a\b\f\r\v$`},
+		{"café \x01\xff", 72, 0, `café \001\377$`},
+		{"abcdefgh", 5, 0, "abcd\\\nefgh\\\n$"},
+		{"ab\tcd", 5, 0, "ab\\t\\\ncd$"},
+		{"abcdefgh", 5, 2, "ab\\\ncdef\\\ngh$"},
+		{"abcdefgh", 0, 0, "abcdefgh$"},
+	} {
+		if l := listLine(c.line, c.cols, c.col); l != c.exp {
+			t.Errorf("%q: expected %q, got %q", c.line, c.exp, l)
+		}
+	}
+
+	var out bytes.Buffer
+	ed := NewEditor(strings.NewReader("a\tb\nc\n.\n"), &out)
+	execAll(t, ed, "a", "1ln", "1,2n", "2dp", "ul", "1,2jn")
+	if exp := "1\ta\\tb$\n1\ta\tb\n2\tc\na\tb\nc$\n1\ta\tbc\n"; out.String() != exp {
+		t.Errorf("expected %q, got %q", exp, out.String())
+	}
+	if e := ed.Exec("pq"); e == nil {
+		t.Errorf("expected an invalid suffix to fail")
+	}
+}
+
+func TestSuffixes(t *testing.T) {
+	var out bytes.Buffer
+	ed := NewEditor(strings.NewReader("one\ntwo\nthree\n.\n"), &out)
+	execAll(t, ed, "an", "1t$p", "1,2m$n", "2z1l", "1,2jp", "ka", "s/e/E/gp", "x", "=", "un")
+	if exp := "3\tthree\none\n4\ttwo\none$\nthreeone\nthrEEonE\n3\n1\tthrEEonE\n"; out.String() != exp {
+		t.Errorf("expected %q, got %q", exp, out.String())
+	}
+	for _, cmd := range []string{"dx", "1,2jj", "qq", "hp", "kA", "kab", "t", "1t$x", "s/o/0/x", "zp3"} {
+		if e := ed.Exec(cmd); e == nil {
+			t.Errorf("%s: expected garbage after the command to fail", cmd)
+		}
+	}
+	// after d, the current line is the one after the deleted lines, or the new last line
+	out.Reset()
+	ed = NewEditor(strings.NewReader("a\nb\nc\nd\ne\n.\n"), &out)
+	for _, cmd := range []string{"a", "2dp", ".=", "$dp", "2,$dp", "=", "dp"} {
+		ed.Exec(cmd)
+	}
+	if exp := "c\n2\nd\na\n1\n"; out.String() != exp {
+		t.Errorf("expected %q, got %q", exp, out.String())
+	}
+	if l := ed.Buffer().Len(); l != 0 {
+		t.Errorf("expected an empty buffer, got %d lines", l)
+	}
+}
+
+func TestWindowSize(t *testing.T) {
+	f, e := ioutil.TempFile("", "ged")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	for _, env := range []string{"LINES", "COLUMNS"} {
+		defer os.Setenv(env, os.Getenv(env))
+	}
+	os.Setenv("LINES", "30")
+	os.Setenv("COLUMNS", "")
+	if lines, cols, ok := WindowSize(f); !ok || lines != 30 || cols != 0 {
+		t.Errorf("expected the size to come from $LINES, got %d, %d, %v", lines, cols, ok)
+	}
+
+	var out bytes.Buffer
+	ed := NewEditor(strings.NewReader(strings.Repeat("abcdefgh\n", 10)+".\n"), &out)
+	ed.Exec("a")
+	ed.SetWindowSize(6, 12)
+	out.Reset()
+	if e = ed.Exec("1z"); e != nil {
+		t.Fatal(e)
+	}
+	if n := strings.Count(out.String(), "\n"); n != 4 {
+		t.Errorf("expected z to scroll 4 lines, got %d", n)
+	}
+	out.Reset()
+	if e = ed.Exec("l"); e != nil {
+		t.Fatal(e)
+	}
+	if exp := "abc\\\ndef\\\ngh$\n"; out.String() != exp {
+		t.Errorf("expected l to fold at 4 columns, got %q", out.String())
+	}
+}
+
+func TestLineEditor(t *testing.T) {
+	dir, remove := tempDir(t, false)
+	defer remove()
+	for _, n := range []string{"apple", "apricot", "banana", ".hidden"} {
+		if e := ioutil.WriteFile(filepath.Join(dir, n), nil, 0644); e != nil {
+			t.Fatal(e)
+		}
+	}
+	os.Mkdir(filepath.Join(dir, "bin"), 0755)
+
+	le := &lineEditor{
+		r:       bufio.NewReader(strings.NewReader("")),
+		out:     ioutil.Discard,
+		cols:    func() int { return 20 },
+		history: []string{"1p", "s/x/y/", ",n"},
+	}
+	for _, c := range []struct {
+		keys string
+		cmd  bool
+		exp  string
+	}{
+		{"\x1b[A\x1b[A\x1b[B\r", true, ",n"},                       // history
+		{"abc\x10\x10\x0e\x0e\r", true, "abc"},                     // ^P^N back to the line being typed
+		{"abc\x7fd\r", true, "abd"},                                // backspace
+		{"abc\x1b[D\x1b[DX\x05Y\r\n", true, "aXbcY"},               // arrows and ^E, \r\n is one line ending
+		{"one two three\x17\x17\x01\x1b[3~\x1bf!\r", true, "ne! "}, // ^W, home, delete, alt-f
+		{"abc\x01\x0b\r", true, ""},                                // ^K
+		{"\x12x/\r", true, "s/x/y/"},                               // ^R search
+		{"\x12zzz\x07keep\r", true, "keep"},                        // ^G cancels the search
+		{"\x12,\x1b[Cq\r", true, ",qn"},                            // a key that isn't for the search ends it
+		{"ab\x03cd\r", true, "cd"},                                 // ^C throws the line away
+		{"\x1b[Ac\r", false, "c"},                                  // no history in text
+		{"a\tb\x16\x01\r", false, "a\tb\x01"},                      // tabs are text, ^V quotes
+		{"long line that scrolls sideways\x01X\r", false, "Xlong line that scrolls sideways"},
+		{"r " + dir + "/ap\t\r", true, "r " + dir + "/ap"},
+		{"r " + dir + "/apr\t\r", true, "r " + dir + "/apricot"},
+		{"w " + dir + "/b\t\r", true, "w " + dir + "/b"},
+		{"1,$W " + dir + "/bi\t\r", true, "1,$W " + dir + "/bin/"},
+		{"e " + dir + "/.h\t\r", true, "e " + dir + "/.hidden"},
+		{"p " + dir + "/ba\t\r", true, "p " + dir + "/ba"},
+		{"end", true, "end"}, // the end of the input ends a line
+	} {
+		le.r = bufio.NewReader(strings.NewReader(c.keys))
+		line, e := le.readLine("*", c.cmd)
+		if e != nil {
+			t.Errorf("%q: %v", c.keys, e)
+		} else if line != c.exp {
+			t.Errorf("%q: expected %q, got %q", c.keys, c.exp, line)
+		}
+	}
+	if h := le.history[len(le.history)-1]; h != "end" {
+		t.Errorf("expected the last command in the history, got %q", h)
+	}
+	for _, keys := range []string{"\x04", "", "x\x7f\x04"} {
+		le.r = bufio.NewReader(strings.NewReader(keys))
+		if _, e := le.readLine("", false); e != io.EOF {
+			t.Errorf("%q: expected EOF, got %v", keys, e)
+		}
+	}
+
+	var out bytes.Buffer
+	le.out = &out
+	le.r = bufio.NewReader(strings.NewReader("0123456789abcdefghijklmnopqrstuvwxyz\r"))
+	le.readLine("*", false)
+	if last := out.String()[strings.LastIndex(out.String(), "\r*"):]; !strings.HasPrefix(last, "\r*jklmnopqrstuvwxyz\x1b[K") {
+		t.Errorf("expected the line to scroll to keep the cursor in view, got %q", last)
+	}
+}
+
+func TestBuffers(t *testing.T) {
+	_, remove := tempDir(t, true)
+	defer remove()
+	ioutil.WriteFile("a", []byte("one\ntwo\nthree\n"), 0644)
+	ioutil.WriteFile("b", []byte("x\ny\n"), 0644)
+
+	var out bytes.Buffer
+	ed := testEditor(t, &out)
+	e := ed.Load("a")
+	if e != nil {
+		t.Fatal(e)
+	}
+	execAll(t, ed, "B b", "1,2t1:0", "B a", "1y", "3m2:$", "B")
+	if exp := "*1\t+\t4\ta\n 2\t+\t3\tb\n"; out.String() != exp {
+		t.Errorf("expected %q, got %q", exp, out.String())
+	}
+	checkLines(t, ed, "x,y,two,three")
+	execAll(t, ed, "$x") // moving doesn't touch the registers
+	checkLines(t, ed, "x,y,two,three,x")
+	execAll(t, ed, "u", "b")
+	checkLines(t, ed, "x,y,one")
+	execAll(t, ed, "u") // each buffer has its own undo
+	checkLines(t, ed, "x,y")
+	execAll(t, ed, "U", "b1", "w")
+	if e = ed.Exec("q"); e == nil || !strings.Contains(e.Error(), "buffer 2") {
+		t.Errorf("expected q to warn about buffer 2, got %v", e)
+	}
+	if e = ed.Hangup(); e != nil {
+		t.Fatal(e)
+	}
+	if b, _ := ioutil.ReadFile("ed.hup.2"); string(b) != "x\ny\none\n" {
+		t.Errorf("expected ed.hup.2 to have buffer 2, got %q", string(b))
+	}
+	if _, e = os.Stat("ed.hup"); !os.IsNotExist(e) {
+		t.Errorf("expected the clean current buffer not to be written")
+	}
+	for _, cmd := range []string{"bq 2", "b 3", "bx", "1t3:0"} {
+		if e = ed.Exec(cmd); e == nil {
+			t.Errorf("%s: expected an error", cmd)
+		}
+	}
+	for _, cmd := range []string{"bQ 2", "q"} {
+		if e = ed.Exec(cmd); e != nil && e != ErrQuit {
+			t.Errorf("%s: %v", cmd, e)
+		}
+	}
+	if e = ed.Exec("bq"); e == nil {
+		t.Errorf("expected closing the only buffer to fail")
+	}
+}
+
+func TestRegisters(t *testing.T) {
+	var out bytes.Buffer
+	ed := testEditor(t, &out, "1", "2", "3", "4", "5", "6")
+	execAll(t, ed, "1y", "2d", "$x", "1,2y\"a", "3y\"A", "1d", "1d", "$x\"0", "$x\"a", "0x\"2")
+	checkLines(t, ed, "1,4,5,6,2,1,1,3,4")
+	for _, cmd := range []string{"x\"b", "x\"9", "y\"1", "d\"!", "x\"", "R !"} {
+		if e := ed.Exec(cmd); e == nil {
+			t.Errorf("%s: expected an error", cmd)
+		}
+	}
+	// an invalid register is refused before anything is cut
+	states := len(ed.Buffer().UndoTree())
+	for _, cmd := range []string{"2d\"1", "1,2c\"5", "2d\"!", "3,4y\"0"} {
+		if e := ed.Exec(cmd); e != ErrRegister {
+			t.Errorf("%s: expected %v, got %v", cmd, ErrRegister, e)
+		}
+	}
+	checkLines(t, ed, "1,4,5,6,2,1,1,3,4")
+	if n := len(ed.Buffer().UndoTree()); n != states {
+		t.Errorf("expected no new undo states, got %d more", n-states)
+	}
+	if e := testEditor(t, &out).Exec("x"); e != ErrNothingToPut {
+		t.Errorf("expected x in an empty buffer to find nothing to put, got %v", e)
+	}
+	// a named register doesn't change the numbered ones
+	execAll(t, ed, "1d\"ap")
+	out.Reset()
+	execAll(t, ed, "R")
+	if exp := "\"\"\t1\n\"0\t1\n\"1\t3\n\"2\t1\n\"3\t2\n\"a\t1\n"; out.String() != exp {
+		t.Errorf("expected %q, got %q", exp, out.String())
+	}
+}
+
+func TestFilter(t *testing.T) {
+	needShell(t)
+	var out bytes.Buffer
+	ed := testEditor(t, &out, "c", "b", "a", "z")
+	execAll(t, ed, "1,3!sort")
+	checkLines(t, ed, "a,b,c,z")
+	if l := ed.Buffer().GetAddr(); l != 2 {
+		t.Errorf("expected the last line of output to be the current line, got %d", l+1)
+	}
+	if e := ed.Exec("2,3!cat; exit 1"); e == nil {
+		t.Errorf("expected a failing command to fail")
+	}
+	checkLines(t, ed, "a,b,c,z")
+	execAll(t, ed, ".!tr a-z A-Z")
+	checkLines(t, ed, "a,b,C,z")
+	execAll(t, ed, "u")
+	checkLines(t, ed, "a,b,c,z")
+	execAll(t, ed, "u")
+	checkLines(t, ed, "c,b,a,z")
+
+	// without an address, ! runs a command, even with whitespace before it or in a global command
+	out.Reset()
+	execAll(t, ed, " !echo hi", "g/[ab]/!echo hi")
+	checkLines(t, ed, "c,b,a,z")
+	if exp := "hi\n!\nhi\n!\nhi\n!\n"; out.String() != exp {
+		t.Errorf("expected %q, got %q", exp, out.String())
+	}
+	execAll(t, ed, " 2!echo hi")
+	checkLines(t, ed, "c,hi,a,z")
+}
+
+func TestExpandCommand(t *testing.T) {
+	for _, c := range []struct {
+		cmd, exp string
+		changed  bool
+	}{
+		{"ls", "ls", false},
+		{"cat %", "cat f.txt", true},
+		{`echo \% %`, "echo % f.txt", true},
+		{`echo \\%`, `echo \\f.txt`, true},
+		{`echo \$HOME \`, `echo \$HOME \`, false},
+		{"!", "wc -l", true},
+		{"! f%", "wc -l ff.txt", true},
+		{`a!b`, `a!b`, false},
+	} {
+		exp, changed, e := ExpandCommand(c.cmd, "f.txt", "wc -l")
+		if e != nil {
+			t.Errorf("%s: %v", c.cmd, e)
+		} else if exp != c.exp || changed != c.changed {
+			t.Errorf("%s: expected %q (%v), got %q (%v)", c.cmd, c.exp, c.changed, exp, changed)
+		}
+	}
+	if _, _, e := ExpandCommand("!", "", ""); e != ErrNoCommand {
+		t.Errorf("expected no previous command, got %v", e)
+	}
+	if _, _, e := ExpandCommand("cat %", "", ""); e == nil {
+		t.Errorf("expected no filename to fail")
+	}
+
+	needShell(t)
+	var out bytes.Buffer
+	ed := NewEditor(strings.NewReader("a\nb\n.\n"), &out)
+	ed.Exec("a")
+	ed.Exec("f a.txt")
+	execAll(t, ed, "w !cat", "!echo %", "!!", "$r !!", "1,$!tr a-z A-Z")
+	if exp := "a\nb\necho a.txt\na.txt\n!\necho a.txt\na.txt\n!\necho a.txt\n10\n10\n"; out.String() != exp {
+		t.Errorf("expected %q, got %q", exp, out.String())
+	}
+	if s := strings.Join(ed.Buffer().Lines(), ","); s != "A,B,A.TXT" {
+		t.Errorf("expected the output of the repeated command to be read and filtered, got %s", s)
+	}
+}
+
+func TestShellLimits(t *testing.T) {
+	needShell(t)
+	var out bytes.Buffer
+	ed := testEditor(t, &out, "a", "b")
+	ed.ShellTimeout = 100 * time.Millisecond
+	start := time.Now()
+	if e := ed.Exec("1,2!exec sleep 5"); e != ErrTimeout {
+		t.Errorf("expected a timeout, got %v", e)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("timeout took %v", d)
+	}
+	checkLines(t, ed, "a,b")
+	if e := ed.Exec("r !echo c"); e != nil {
+		t.Errorf("expected a quick command to run, got %v", e)
+	}
+	checkLines(t, ed, "a,b,c")
+	ed.ShellTimeout = 0
+
+	ed.ShellMaxOutput = 1000
+	if e := ed.Exec("r !exec yes"); e != ErrOutputLimit {
+		t.Errorf("expected the output to be too large, got %v", e)
+	}
+	if e := ed.Exec("1,$!head -c 1001 /dev/zero"); e != ErrOutputLimit {
+		t.Errorf("expected the output to be too large, got %v", e)
+	}
+	checkLines(t, ed, "a,b,c")
+	if e := ed.Exec("1,$!head -c 999 /dev/zero; echo"); e != nil {
+		t.Errorf("expected output under the limit to be read, got %v", e)
+	}
+	if l := ed.Buffer().Len(); l != 1 {
+		t.Errorf("expected 1 line, got %d", l)
+	}
+	execAll(t, ed, "u")
+	checkLines(t, ed, "a,b,c")
+
+	execAll(t, ed, "$r !echo out; echo err >&2")
+	checkLines(t, ed, "a,b,c,out")
+	ed.ShellStderr = true
+	execAll(t, ed, "$r !echo out; echo err >&2")
+	checkLines(t, ed, "a,b,c,out,out,err")
+}
+
+func TestShellEnv(t *testing.T) {
+	needShell(t)
+	var out bytes.Buffer
+	ed := NewEditor(strings.NewReader("a\nb\nc\n.\n"), &out)
+	ed.Suppress = true
+	env := "echo $GED_FILE $GED_LINE $GED_LINES $GED_DIRTY $GED_FIRST $GED_LAST"
+	for _, c := range []struct {
+		cmd, exp string
+	}{
+		{"!" + env, "0 0 0 0 0\n!\n"},
+		{"a", ""},
+		{"f a.txt", ""},
+		{"2", "b\n"},
+		{"!" + env, "a.txt 2 3 1 2 2\n!\n"},
+		{"2,3w !" + env, "a.txt 2 3 1 2 3\n"},
+		{"1r !" + env, ""},
+		{"2p", "a.txt 3 3 1 1 1\n"},
+		{"1,$!" + env, ""},
+		{"1p", "a.txt 2 4 1 1 4\n"},
+	} {
+		out.Reset()
+		if e := ed.Exec(c.cmd); e != nil {
+			t.Fatalf("%s: %v", c.cmd, e)
+		}
+		if out.String() != c.exp {
+			t.Errorf("%s: expected %q, got %q", c.cmd, c.exp, out.String())
+		}
+	}
+}
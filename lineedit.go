@@ -0,0 +1,538 @@
+// lineedit.go - implements the line editor the Terminal uses to read lines
+package ged
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Keys that aren't characters are read as negative runes
+const (
+	keyNone rune = -1 - iota // an escape sequence we don't know
+	keyUp
+	keyDown
+	keyLeft
+	keyRight
+	keyHome
+	keyEnd
+	keyDelete
+	keyWordLeft
+	keyWordRight
+	keyDeleteWord    // delete the word after the cursor
+	keyBackspaceWord // delete the word before the cursor
+)
+
+// Control characters
+const (
+	ctrlA     = 'a' & 0x1f
+	ctrlB     = 'b' & 0x1f
+	ctrlC     = 'c' & 0x1f
+	ctrlD     = 'd' & 0x1f
+	ctrlE     = 'e' & 0x1f
+	ctrlF     = 'f' & 0x1f
+	ctrlG     = 'g' & 0x1f
+	ctrlH     = 'h' & 0x1f
+	ctrlK     = 'k' & 0x1f
+	ctrlL     = 'l' & 0x1f
+	ctrlN     = 'n' & 0x1f
+	ctrlP     = 'p' & 0x1f
+	ctrlR     = 'r' & 0x1f
+	ctrlU     = 'u' & 0x1f
+	ctrlV     = 'v' & 0x1f
+	ctrlW     = 'w' & 0x1f
+	ctrlZ     = 'z' & 0x1f
+	keyTab    = '\t'
+	keyEsc    = 0x1b
+	keyDel    = 0x7f
+	keyCR     = '\r'
+	keyLF     = '\n'
+	clearLine = "\x1b[K"
+)
+
+// readKey reads a key, turning the escape sequences terminals send for special keys into a single rune
+func readKey(r *bufio.Reader) (k rune, e error) {
+	if k, _, e = r.ReadRune(); e != nil || k != keyEsc {
+		return
+	}
+	// a sequence arrives all at once, so if nothing follows the escape it was a lone escape
+	if r.Buffered() == 0 {
+		return keyEsc, nil
+	}
+	var c rune
+	if c, _, e = r.ReadRune(); e != nil {
+		return
+	}
+	switch c {
+	case '[', 'O':
+		return readCSI(r)
+	case 'b', 'B':
+		return keyWordLeft, nil
+	case 'f', 'F':
+		return keyWordRight, nil
+	case 'd', 'D':
+		return keyDeleteWord, nil
+	case keyDel, ctrlH:
+		return keyBackspaceWord, nil
+	}
+	return keyNone, nil
+}
+
+// readCSI reads the rest of a control sequence (ESC [ or ESC O): parameters and a final byte
+func readCSI(r *bufio.Reader) (k rune, e error) {
+	var params []byte
+	var c byte
+	for {
+		if c, e = r.ReadByte(); e != nil {
+			return
+		}
+		if c < '0' || c > '?' {
+			break
+		}
+		params = append(params, c)
+	}
+	p := string(params)
+	// a modifier (e.g. "1;5C") means ctrl or alt with an arrow, which move by words
+	mod := strings.Contains(p, ";")
+	switch c {
+	case 'A':
+		return keyUp, nil
+	case 'B':
+		return keyDown, nil
+	case 'C':
+		if mod {
+			return keyWordRight, nil
+		}
+		return keyRight, nil
+	case 'D':
+		if mod {
+			return keyWordLeft, nil
+		}
+		return keyLeft, nil
+	case 'H':
+		return keyHome, nil
+	case 'F':
+		return keyEnd, nil
+	case '~':
+		switch p {
+		case "1", "7":
+			return keyHome, nil
+		case "4", "8":
+			return keyEnd, nil
+		case "3":
+			return keyDelete, nil
+		}
+	}
+	return keyNone, nil
+}
+
+// A lineEditor reads lines from a terminal in raw mode, and lets them be edited as they're typed
+type lineEditor struct {
+	r       *bufio.Reader
+	out     io.Writer
+	cols    func() int // the width of the terminal
+	suspend func()     // stops ged for ^Z, nil to ignore it
+	history []string   // commands read, oldest first
+}
+
+// readLine reads a line, showing prompt before it.
+// Commands (cmd set) are added to the history, and can be recalled from it, searched for in it with ^R,
+// and have filenames completed with tab.  Anything else is text, where a tab is just a tab.
+// It returns io.EOF for ^D on an empty line, or the end of the input with nothing typed.
+func (l *lineEditor) readLine(prompt string, cmd bool) (line string, e error) {
+	s := &lineState{lineEditor: l, prompt: prompt, cmd: cmd, hist: len(l.history)}
+	for {
+		s.refresh()
+		var k rune
+		if k, e = readKey(l.r); e != nil {
+			if e == io.EOF && len(s.buf) > 0 {
+				break
+			}
+			io.WriteString(l.out, "\n")
+			return
+		}
+		if s.search != nil && s.searchKey(k) {
+			continue
+		}
+		if s.key(k) {
+			break
+		}
+		if s.eof {
+			io.WriteString(l.out, "\n")
+			return "", io.EOF
+		}
+	}
+	io.WriteString(l.out, "\n")
+	line = string(s.buf)
+	if cmd && len(line) > 0 && (len(l.history) == 0 || l.history[len(l.history)-1] != line) {
+		l.history = append(l.history, line)
+	}
+	return line, nil
+}
+
+// A lineState is a line being edited
+type lineState struct {
+	*lineEditor
+	prompt string
+	cmd    bool
+	buf    []rune
+	pos    int    // the cursor, as an index into buf
+	off    int    // the first rune shown, when the line is too long for the terminal
+	eof    bool   // ^D was typed on an empty line
+	hist   int    // the history entry being edited, len(history) is the line being typed
+	typed  []rune // the line being typed, while the history is being looked at
+
+	search []rune // what ^R is looking for, nil if we're not searching
+	failed bool   // the search found nothing
+	before []rune // the line before the search
+	from   int    // the history entry before the search
+}
+
+// key handles a key, and returns true when the line is finished
+func (s *lineState) key(k rune) (done bool) {
+	switch k {
+	case keyCR:
+		// a pasted \r\n is one line ending
+		if s.r.Buffered() > 0 {
+			if b, e := s.r.Peek(1); e == nil && b[0] == keyLF {
+				s.r.ReadByte()
+			}
+		}
+		return true
+	case keyLF:
+		return true
+	case ctrlA, keyHome:
+		s.pos = 0
+	case ctrlE, keyEnd:
+		s.pos = len(s.buf)
+	case ctrlB, keyLeft:
+		if s.pos > 0 {
+			s.pos--
+		}
+	case ctrlF, keyRight:
+		if s.pos < len(s.buf) {
+			s.pos++
+		}
+	case keyWordLeft:
+		s.pos = s.wordStart()
+	case keyWordRight:
+		s.pos = s.wordEnd()
+	case keyDel, ctrlH:
+		if s.pos > 0 {
+			s.delete(s.pos-1, s.pos)
+		}
+	case ctrlD:
+		if len(s.buf) == 0 {
+			s.eof = true
+		} else if s.pos < len(s.buf) {
+			s.delete(s.pos, s.pos+1)
+		}
+	case keyDelete:
+		if s.pos < len(s.buf) {
+			s.delete(s.pos, s.pos+1)
+		}
+	case ctrlK:
+		s.delete(s.pos, len(s.buf))
+	case ctrlU:
+		s.delete(0, s.pos)
+	case ctrlW, keyBackspaceWord:
+		s.delete(s.wordStart(), s.pos)
+	case keyDeleteWord:
+		s.delete(s.pos, s.wordEnd())
+	case ctrlL:
+		io.WriteString(s.out, "\x1b[H\x1b[2J")
+	case ctrlC:
+		// ISIG is off, so ^C doesn't interrupt us, it just throws the line away (with a ? at the prompt, like GNU Ed)
+		io.WriteString(s.out, "^C\n")
+		if s.cmd {
+			io.WriteString(s.out, "?\n")
+		}
+		s.buf, s.pos, s.off, s.hist = nil, 0, 0, len(s.history)
+	case ctrlZ:
+		if s.suspend != nil {
+			io.WriteString(s.out, "\n")
+			s.suspend()
+		}
+	case ctrlV:
+		// the next character is inserted as it is, even if it's a control character
+		if c, _, e := s.r.ReadRune(); e == nil {
+			s.insert([]rune{c})
+		}
+	case ctrlP, keyUp:
+		if s.cmd && s.hist > 0 {
+			s.recall(s.hist - 1)
+		}
+	case ctrlN, keyDown:
+		if s.cmd && s.hist < len(s.history) {
+			s.recall(s.hist + 1)
+		}
+	case ctrlR:
+		if s.cmd {
+			s.search, s.failed = []rune{}, false
+			s.before, s.from = append([]rune(nil), s.buf...), s.hist
+		}
+	case keyTab:
+		if s.cmd {
+			s.complete()
+		} else {
+			s.insert([]rune{k})
+		}
+	default:
+		if k >= ' ' {
+			s.insert([]rune{k})
+		}
+	}
+	return false
+}
+
+// searchKey handles a key while searching the history.
+// It returns false if the key ends the search and should be handled as usual.
+func (s *lineState) searchKey(k rune) bool {
+	switch k {
+	case ctrlR:
+		s.find(s.hist - 1)
+	case keyDel, ctrlH:
+		if len(s.search) > 0 {
+			s.search = s.search[:len(s.search)-1]
+			s.find(len(s.history) - 1)
+		}
+	case ctrlG, ctrlC:
+		s.recall(s.from)
+		s.buf, s.pos = s.before, len(s.before)
+		s.search = nil
+	default:
+		if k < ' ' || k == keyDel {
+			s.search = nil
+			return false
+		}
+		s.search = append(s.search, k)
+		s.find(s.hist)
+	}
+	return true
+}
+
+// find finds the newest history entry, starting at from, that contains what we're searching for
+func (s *lineState) find(from int) {
+	if len(s.search) == 0 {
+		s.failed = false
+		return
+	}
+	q := string(s.search)
+	if from >= len(s.history) {
+		from = len(s.history) - 1
+	}
+	for i := from; i >= 0; i-- {
+		if n := strings.Index(s.history[i], q); n >= 0 {
+			s.recall(i)
+			s.pos = len([]rune(s.history[i][:n]))
+			s.failed = false
+			return
+		}
+	}
+	s.failed = true
+}
+
+// recall replaces the line with an entry from the history, keeping what was typed
+func (s *lineState) recall(h int) {
+	if s.hist == len(s.history) {
+		s.typed = s.buf
+	}
+	s.hist = h
+	if h == len(s.history) {
+		s.buf = s.typed
+	} else {
+		s.buf = []rune(s.history[h])
+	}
+	s.pos = len(s.buf)
+}
+
+// insert inserts runes at the cursor
+func (s *lineState) insert(r []rune) {
+	buf := make([]rune, 0, len(s.buf)+len(r))
+	buf = append(append(append(buf, s.buf[:s.pos]...), r...), s.buf[s.pos:]...)
+	s.buf = buf
+	s.pos += len(r)
+}
+
+// delete deletes the runes from i to j, leaving the cursor at i
+func (s *lineState) delete(i, j int) {
+	buf := make([]rune, 0, len(s.buf)-(j-i))
+	s.buf = append(append(buf, s.buf[:i]...), s.buf[j:]...)
+	s.pos = i
+}
+
+// isWord says whether a rune is part of a word, for moving and deleting by words
+func isWord(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// wordStart finds the start of the word before the cursor
+func (s *lineState) wordStart() int {
+	i := s.pos
+	for i > 0 && !isWord(s.buf[i-1]) {
+		i--
+	}
+	for i > 0 && isWord(s.buf[i-1]) {
+		i--
+	}
+	return i
+}
+
+// wordEnd finds the end of the word after the cursor
+func (s *lineState) wordEnd() int {
+	i := s.pos
+	for i < len(s.buf) && !isWord(s.buf[i]) {
+		i++
+	}
+	for i < len(s.buf) && isWord(s.buf[i]) {
+		i++
+	}
+	return i
+}
+
+// runeWidth is how many columns a rune is shown in, control characters are shown as ^X
+func runeWidth(r rune) int {
+	if r < ' ' || r == keyDel {
+		return 2
+	}
+	return 1
+}
+
+// showRune is how a rune is shown
+func showRune(r rune) string {
+	switch {
+	case r == keyDel:
+		return "^?"
+	case r < ' ':
+		return "^" + string(r+'@')
+	}
+	return string(r)
+}
+
+// refresh redraws the line.  A line too long for the terminal scrolls sideways to keep the cursor in view.
+func (s *lineState) refresh() {
+	prompt := s.prompt
+	if s.search != nil {
+		failed := ""
+		if s.failed {
+			failed = "failed "
+		}
+		prompt = fmt.Sprintf("(%sreverse-i-search)`%s': ", failed, string(s.search))
+	}
+	// leave the last column empty, so the cursor never wraps
+	avail := s.cols() - 1 - len([]rune(prompt))
+	if avail < 1 {
+		avail = 1
+	}
+	width := func(i, j int) (w int) {
+		for _, r := range s.buf[i:j] {
+			w += runeWidth(r)
+		}
+		return
+	}
+	if s.pos < s.off {
+		s.off = s.pos
+	}
+	for s.off < s.pos && width(s.off, s.pos) >= avail {
+		s.off++
+	}
+	// if the line got shorter, show as much as fits
+	for s.off > 0 && width(s.off-1, len(s.buf)) < avail {
+		s.off--
+	}
+	var out strings.Builder
+	out.WriteString("\r" + prompt)
+	w := 0
+	for _, r := range s.buf[s.off:] {
+		if w += runeWidth(r); w > avail {
+			break
+		}
+		out.WriteString(showRune(r))
+	}
+	out.WriteString(clearLine + "\r")
+	if n := len([]rune(prompt)) + width(s.off, s.pos); n > 0 {
+		fmt.Fprintf(&out, "\x1b[%dC", n)
+	}
+	io.WriteString(s.out, out.String())
+}
+
+// rxFileCmd matches the start of a command that takes a filename
+var rxFileCmd = regexp.MustCompile(`^(?:[0-9.$,;%+\-^\s]|'[a-z])*(?:[eErfWB]|wq?)\s*`)
+
+// complete completes the filename before the cursor, if it's the argument of e, E, r, f, w, wq, W or B.
+// If more than one file matches, their common prefix is completed, and if there is none they're listed.
+func (s *lineState) complete() {
+	head := string(s.buf[:s.pos])
+	m := rxFileCmd.FindStringIndex(head)
+	if m == nil || strings.HasPrefix(head[m[1]:], "!") {
+		io.WriteString(s.out, "\a")
+		return
+	}
+	word := []rune(head[m[1]:])
+	names := completeFile(string(word))
+	if len(names) == 0 {
+		io.WriteString(s.out, "\a")
+		return
+	}
+	common := []rune(names[0])
+	for _, n := range names[1:] {
+		r := []rune(n)
+		i := 0
+		for i < len(common) && i < len(r) && common[i] == r[i] {
+			i++
+		}
+		common = common[:i]
+	}
+	if len(common) > len(word) {
+		s.insert(common[len(word):])
+		return
+	}
+	if len(names) > 1 {
+		list := make([]string, len(names))
+		for i, n := range names {
+			list[i] = filepath.Base(n)
+			if strings.HasSuffix(n, "/") {
+				list[i] += "/"
+			}
+		}
+		fmt.Fprintf(s.out, "\n%s\n", strings.Join(list, "  "))
+	}
+}
+
+// completeFile finds the files whose names start with prefix, directories end with a /.
+// Hidden files are only included if the prefix of their name starts with a dot.
+func completeFile(prefix string) (names []string) {
+	dir, base := filepath.Split(prefix)
+	d := dir
+	if len(d) == 0 {
+		d = "."
+	}
+	infos, e := ioutil.ReadDir(d)
+	if e != nil {
+		return
+	}
+	for _, fi := range infos {
+		n := fi.Name()
+		if !strings.HasPrefix(n, base) || strings.HasPrefix(n, ".") && !strings.HasPrefix(base, ".") {
+			continue
+		}
+		n = dir + n
+		if fi.IsDir() || fi.Mode()&os.ModeSymlink != 0 && isDir(n) {
+			n += "/"
+		}
+		names = append(names, n)
+	}
+	return
+}
+
+// isDir says whether a file is a directory, following symlinks
+func isDir(file string) bool {
+	fi, e := os.Stat(file)
+	return e == nil && fi.IsDir()
+}
@@ -0,0 +1,281 @@
+// linemap.go - defines the lineMap, which maps file lines to buffer lines for FileBuffer
+package ged
+
+import "math/rand"
+
+// A span is a run of consecutive buffer lines in the file (the "pieces" of a piece table).
+// Spans are kept in a treap ordered by their position in the file, so we can find, insert and
+// delete lines in logarithmic time.  The same spans are also kept in a second treap ordered by
+// buffer line, so we can find where a buffer line is in the file (e.g. for marks).
+type span struct {
+	start  int   // first buffer line
+	count  int   // number of buffer lines
+	prio   int   // treap priority
+	size   int   // number of lines in this subtree of the file treap
+	left   *span // file treap
+	right  *span // file treap
+	parent *span // file treap
+	kleft  *span // buffer line treap
+	kright *span // buffer line treap
+}
+
+// A piece is a span without the trees, used to take snapshots of a lineMap
+type piece struct {
+	start int
+	count int
+}
+
+// A lineMap is the sequence of buffer lines that make up a file.
+// The zero value is an empty file.
+type lineMap struct {
+	root  *span // spans ordered by file position
+	index *span // spans ordered by buffer line
+}
+
+// newLineMap builds a lineMap from a snapshot
+func newLineMap(pieces []piece) (m lineMap) {
+	for _, p := range pieces {
+		m.root = merge(m.root, m.newSpan(p.start, p.count))
+	}
+	m.setRoot(m.root)
+	return
+}
+
+// Len returns the number of lines in the file
+func (m *lineMap) Len() int {
+	return size(m.root)
+}
+
+// At returns the buffer line at a file line, which must be in bounds
+func (m *lineMap) At(l int) int {
+	n, off := m.find(l)
+	return n.start + off
+}
+
+// Line finds the file line of a buffer line, ok is false if it's not in the file
+func (m *lineMap) Line(b int) (l int, ok bool) {
+	var n *span
+	for t := m.index; t != nil; {
+		if t.start <= b {
+			n = t
+			t = t.kright
+		} else {
+			t = t.kleft
+		}
+	}
+	if n == nil || b >= n.start+n.count {
+		return -1, false
+	}
+	l = size(n.left) + b - n.start
+	for c := n; c.parent != nil; c = c.parent {
+		if c == c.parent.right {
+			l += size(c.parent.left) + c.parent.count
+		}
+	}
+	return l, true
+}
+
+// Insert inserts count buffer lines, starting at buffer line start, before file line l
+func (m *lineMap) Insert(l, start, count int) {
+	if count <= 0 {
+		return
+	}
+	if l > 0 {
+		// lines usually follow on from the line before them in the buffer, so try to extend its span
+		n, off := m.find(l - 1)
+		if off == n.count-1 && n.start+n.count == start {
+			n.count += count
+			for ; n != nil; n = n.parent {
+				n.size += count
+			}
+			return
+		}
+	}
+	a, b := m.split(m.root, l)
+	m.setRoot(merge(merge(a, m.newSpan(start, count)), b))
+}
+
+// Delete removes count lines starting at file line l
+func (m *lineMap) Delete(l, count int) {
+	a, b := m.split(m.root, l)
+	mid, c := m.split(b, count)
+	walk(mid, m.unindex)
+	m.setRoot(merge(a, c))
+}
+
+// Move moves count lines starting at file line l so that they come before file line dest.
+// dest must not be inside the lines being moved.
+func (m *lineMap) Move(l, count, dest int) {
+	if dest > l {
+		dest -= count
+	}
+	a, b := m.split(m.root, l)
+	mid, c := m.split(b, count)
+	a, c = m.split(merge(a, c), dest)
+	m.setRoot(merge(merge(a, mid), c))
+}
+
+// Pieces takes a snapshot of the lineMap
+func (m *lineMap) Pieces() (pieces []piece) {
+	walk(m.root, func(n *span) {
+		pieces = append(pieces, piece{n.start, n.count})
+	})
+	return
+}
+
+// find finds the span containing file line l, and the offset of l in the span
+func (m *lineMap) find(l int) (n *span, off int) {
+	n = m.root
+	for n != nil {
+		ls := size(n.left)
+		switch {
+		case l < ls:
+			n = n.left
+		case l < ls+n.count:
+			return n, l - ls
+		default:
+			l -= ls + n.count
+			n = n.right
+		}
+	}
+	panic("lineMap: line out of bounds")
+}
+
+// newSpan creates a span and adds it to the index, it still needs to be merged into the file
+func (m *lineMap) newSpan(start, count int) (n *span) {
+	n = &span{
+		start: start,
+		count: count,
+		prio:  rand.Int(),
+		size:  count,
+	}
+	a, b := ksplit(m.index, start)
+	m.index = kmerge(kmerge(a, n), b)
+	return
+}
+
+// unindex removes a span from the index
+func (m *lineMap) unindex(n *span) {
+	a, b := ksplit(m.index, n.start)
+	_, b = ksplit(b, n.start+1)
+	m.index = kmerge(a, b)
+	n.kleft, n.kright = nil, nil
+}
+
+// setRoot sets the root of the file treap
+func (m *lineMap) setRoot(n *span) {
+	m.root = n
+	if n != nil {
+		n.parent = nil
+	}
+}
+
+// split splits a file treap so that the first k lines are in l, and the rest in r.
+// If k falls inside a span, the span is split in two.
+func (m *lineMap) split(t *span, k int) (l, r *span) {
+	if t == nil {
+		return
+	}
+	ls := size(t.left)
+	switch {
+	case k <= ls:
+		l, t.left = m.split(t.left, k)
+		update(t)
+		r = t
+	case k >= ls+t.count:
+		t.right, r = m.split(t.right, k-ls-t.count)
+		update(t)
+		l = t
+	default:
+		off := k - ls
+		tail := m.newSpan(t.start+off, t.count-off)
+		t.count = off
+		r = merge(tail, t.right)
+		t.right = nil
+		update(t)
+		l = t
+	}
+	if l != nil {
+		l.parent = nil
+	}
+	if r != nil {
+		r.parent = nil
+	}
+	return
+}
+
+// merge joins two file treaps, all of a comes before b
+func merge(a, b *span) *span {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	if a.prio > b.prio {
+		a.right = merge(a.right, b)
+		update(a)
+		return a
+	}
+	b.left = merge(a, b.left)
+	update(b)
+	return b
+}
+
+// ksplit splits a buffer line treap so spans starting before key are in l, and the rest in r
+func ksplit(t *span, key int) (l, r *span) {
+	if t == nil {
+		return
+	}
+	if t.start < key {
+		t.kright, r = ksplit(t.kright, key)
+		return t, r
+	}
+	l, t.kleft = ksplit(t.kleft, key)
+	return l, t
+}
+
+// kmerge joins two buffer line treaps, all of a comes before b
+func kmerge(a, b *span) *span {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	if a.prio > b.prio {
+		a.kright = kmerge(a.kright, b)
+		return a
+	}
+	b.kleft = kmerge(a, b.kleft)
+	return b
+}
+
+// update recalculates the size of a file treap node, and adopts its children
+func update(n *span) {
+	n.size = n.count + size(n.left) + size(n.right)
+	if n.left != nil {
+		n.left.parent = n
+	}
+	if n.right != nil {
+		n.right.parent = n
+	}
+}
+
+// size is the number of lines in a file treap, nil is empty
+func size(n *span) int {
+	if n == nil {
+		return 0
+	}
+	return n.size
+}
+
+// walk calls fn for every span in a file treap, in file order
+func walk(n *span, fn func(*span)) {
+	if n == nil {
+		return
+	}
+	walk(n.left, fn)
+	fn(n)
+	walk(n.right, fn)
+}
@@ -0,0 +1,68 @@
+// linereader.go - defines the lineReader, for reading lines of any length
+package ged
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// A lineScanner reads lines, like a bufio.Scanner
+type lineScanner interface {
+	Scan() bool
+	Text() string
+	Err() error
+}
+
+// A lineReader reads lines in the same way as a bufio.Scanner splitting on lines,
+// but without a maximum line length.  A line is only limited by available memory.
+// It also remembers how each line ended, so files can be written back the way they were read.
+type lineReader struct {
+	r    *bufio.Reader
+	line string
+	cr   bool // the last line ended in \r\n
+	nl   bool // the last line ended in \n (it may not at the end of the input)
+	err  error
+}
+
+// newLineReader creates a lineReader reading from r
+func newLineReader(r io.Reader) *lineReader {
+	return &lineReader{r: bufio.NewReader(r)}
+}
+
+// Scan reads the next line, it returns false at the end of the input or on an error
+func (l *lineReader) Scan() bool {
+	if l.err != nil {
+		return false
+	}
+	line, e := l.r.ReadString('\n')
+	if e != nil {
+		l.err = e
+		if e != io.EOF || len(line) == 0 {
+			// don't hand out a partial line if the read failed
+			return false
+		}
+	}
+	l.nl = strings.HasSuffix(line, "\n")
+	line = strings.TrimSuffix(line, "\n")
+	// a \r is only part of the line ending if it comes right before the \n
+	l.cr = l.nl && strings.HasSuffix(line, "\r")
+	if l.cr {
+		line = line[:len(line)-1]
+	}
+	l.line = line
+	return true
+}
+
+// Text returns the last line read, without its line ending
+func (l *lineReader) Text() string {
+	return l.line
+}
+
+// Err returns the first error that was encountered, other than io.EOF
+func (l *lineReader) Err() error {
+	if l.err == io.EOF {
+		return nil
+	}
+	return l.err
+}
@@ -0,0 +1,12 @@
+//go:build windows || plan9
+// +build windows plan9
+
+// owner_other.go - file ownership for systems without unix owners
+package ged
+
+import "os"
+
+// chown does nothing, there's no owner to keep
+func chown(file string, fi os.FileInfo) error {
+	return nil
+}
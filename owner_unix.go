@@ -0,0 +1,19 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+// owner_unix.go - file ownership for systems that have it
+package ged
+
+import (
+	"os"
+	"syscall"
+)
+
+// chown gives a file the same owner and group as fi
+func chown(file string, fi os.FileInfo) error {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	return os.Chown(file, int(st.Uid), int(st.Gid))
+}
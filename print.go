@@ -0,0 +1,106 @@
+// print.go - implements printing lines for p, l and n, and the print suffixes of other commands
+package ged
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A printMode says how to print a line, as the p, l and n commands and suffixes do
+type printMode int
+
+const (
+	printPlain  printMode = 1 << iota // p
+	printList                         // l
+	printNumber                       // n
+)
+
+// What may follow a command is checked before it runs.
+// Commands that aren't listed here take arguments, and check what follows them themselves.
+const (
+	suffixOnly = "acdijlnpuUxy=" // nothing but a print suffix
+	noSuffix   = "hHPqQD"        // nothing at all
+)
+
+// ErrSuffix something other than a print suffix followed a command
+var ErrSuffix = fmt.Errorf("invalid command suffix")
+
+// parseSuffix parses a print suffix, any combination of p, l and n
+func parseSuffix(s string) (m printMode, e error) {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case 'p':
+			m |= printPlain
+		case 'l':
+			m |= printList
+		case 'n':
+			m |= printNumber
+		default:
+			return 0, ErrSuffix
+		}
+	}
+	return
+}
+
+// printLine prints a line and makes it the current line
+func (ed *Editor) printLine(l int, m printMode) (e error) {
+	line := ed.buffer.GetMust(l, true)
+	prefix := ""
+	if m&printNumber != 0 {
+		prefix = fmt.Sprintf("%d\t", l+1)
+	}
+	if m&printList != 0 {
+		col := 0
+		if len(prefix) > 0 {
+			col = 8 // after the tab
+		}
+		line = listLine(line, ed.winCols, col)
+	}
+	_, e = fmt.Fprintf(ed.out, "%s%s\n", prefix, line)
+	return
+}
+
+// listEscapes are the characters l escapes with a backslash, other unprintable characters are written in octal
+var listEscapes = map[byte]string{
+	'\a': `\a`,
+	'\b': `\b`,
+	'\f': `\f`,
+	'\r': `\r`,
+	'\t': `\t`,
+	'\v': `\v`,
+	'\\': `\\`,
+	'$':  `\$`,
+}
+
+// listLine formats a line the way l prints it: unambiguously, folded with a \ to fit in cols columns, and ending in $.
+// col is the column the line starts in.  Lines aren't folded if cols is less than 2.
+func listLine(line string, cols, col int) string {
+	var out strings.Builder
+	add := func(s string) {
+		w := utf8.RuneCountInString(s)
+		if cols > 1 && col+w > cols-1 {
+			out.WriteString("\\\n")
+			col = 0
+		}
+		out.WriteString(s)
+		col += w
+	}
+	for i := 0; i < len(line); {
+		r, n := utf8.DecodeRuneInString(line[i:])
+		switch esc, ok := listEscapes[line[i]]; {
+		case ok:
+			add(esc)
+		case r == utf8.RuneError && n == 1, !unicode.IsPrint(r):
+			for _, b := range []byte(line[i : i+n]) {
+				add(fmt.Sprintf("\\%03o", b))
+			}
+		default:
+			add(line[i : i+n])
+		}
+		i += n
+	}
+	add("$")
+	return out.String()
+}
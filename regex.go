@@ -0,0 +1,283 @@
+// regex.go - translates POSIX regular expressions into go's regexp syntax
+package ged
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrNoRegexp an empty pattern was used before any other
+var ErrNoRegexp = fmt.Errorf("no previous regular expression")
+
+// regexpCache is the number of compiled regular expressions a regexps keeps
+const regexpCache = 32
+
+// A regexps compiles the regular expressions used by addresses, s and the global commands.
+// It remembers the last one, which an empty pattern uses, and caches the compiled ones so
+// searching again doesn't mean compiling again.
+type regexps struct {
+	extended bool // see compileRE
+	last     string
+	cache    map[string]*regexp.Regexp
+	order    []string // cache keys, oldest first
+}
+
+// compile compiles a pattern, or the last pattern if it's empty
+func (r *regexps) compile(pat string) (rx *regexp.Regexp, e error) {
+	if len(pat) == 0 {
+		if len(r.last) == 0 {
+			return nil, ErrNoRegexp
+		}
+		pat = r.last
+	}
+	key := "B" + pat
+	if r.extended {
+		key = "E" + pat
+	}
+	if rx = r.cache[key]; rx == nil {
+		if rx, e = compileRE(pat, r.extended); e != nil {
+			return
+		}
+		if r.cache == nil {
+			r.cache = make(map[string]*regexp.Regexp, regexpCache)
+		}
+		if len(r.order) == regexpCache {
+			delete(r.cache, r.order[0])
+			r.order = r.order[1:]
+		}
+		r.cache[key] = rx
+		r.order = append(r.order, key)
+	}
+	r.last = pat
+	return
+}
+
+// compileRE compiles a POSIX basic regular expression (BRE), or an extended one (ERE) if extended is set.
+// Like POSIX, the leftmost-longest match is found.
+// GNU extensions are supported too: \+, \?, \| in BREs, and \<, \>, \b, \B, \w, \W, \s, \S, \` and \' in both.
+func compileRE(pat string, extended bool) (rx *regexp.Regexp, e error) {
+	var t string
+	if t, e = translateRE(pat, extended); e != nil {
+		return
+	}
+	if rx, e = regexp.Compile(t); e != nil {
+		return nil, fmt.Errorf("invalid regexp: %v", e)
+	}
+	rx.Longest()
+	return
+}
+
+// quoteChar writes the character at pat[i] as a literal, all of it if it's more than one byte of UTF-8,
+// and returns the index of its last byte
+func quoteChar(out *strings.Builder, pat string, i int) int {
+	_, n := utf8.DecodeRuneInString(pat[i:])
+	out.WriteString(regexp.QuoteMeta(pat[i : i+n]))
+	return i + n - 1
+}
+
+// translateRE translates a POSIX regular expression into go's syntax
+func translateRE(pat string, extended bool) (string, error) {
+	var out strings.Builder
+	start := true   // at the start of the expression, or of a group or alternative
+	repeat := false // did the last thing we wrote repeat something?
+	depth := 0      // open groups
+	for i := 0; i < len(pat); i++ {
+		c := pat[i]
+		wasStart := start
+		start = false
+		wasRepeat := repeat
+		repeat = false
+		// the operators are the same in both, but BRE escapes them and ERE doesn't
+		op := byte(0)
+		escaped := c == '\\'
+		if escaped {
+			if i+1 >= len(pat) {
+				return "", fmt.Errorf("trailing backslash (\\)")
+			}
+			i++
+			c = pat[i]
+			if !extended && strings.IndexByte("(){}+?|", c) >= 0 {
+				op = c
+			}
+		} else if extended && strings.IndexByte("(){}+?|", c) >= 0 || strings.IndexByte("*^$.[", c) >= 0 {
+			op = c
+		}
+		if op == 0 && !escaped {
+			i = quoteChar(&out, pat, i)
+			continue
+		}
+		if op == 0 {
+			switch c {
+			case '<', '>':
+				out.WriteString(`\b`)
+			case 'b', 'B', 'w', 'W', 's', 'S':
+				out.WriteString(`\` + string(c))
+			case '`':
+				out.WriteString(`\A`)
+			case '\'':
+				out.WriteString(`\z`)
+			case 'n':
+				out.WriteString(`\n`)
+			case '1', '2', '3', '4', '5', '6', '7', '8', '9':
+				return "", fmt.Errorf("back-references are not supported in patterns")
+			default:
+				i = quoteChar(&out, pat, i)
+			}
+			continue
+		}
+		switch op {
+		case '(':
+			depth++
+			out.WriteByte('(')
+			start = true
+		case ')':
+			if depth == 0 {
+				if extended {
+					out.WriteString(`\)`)
+					continue
+				}
+				return "", fmt.Errorf("unmatched \\)")
+			}
+			depth--
+			out.WriteByte(')')
+		case '|':
+			out.WriteByte('|')
+			start = true
+		case '*', '+', '?':
+			switch {
+			case wasStart:
+				// nothing to repeat, so it's literal
+				out.WriteString(`\` + string(op))
+			case wasRepeat:
+				// repeating a repeat is the same as repeating once, but go doesn't allow it
+				repeat = true
+			default:
+				out.WriteByte(op)
+				repeat = true
+			}
+		case '{':
+			n, ok := interval(pat[i+1:], extended)
+			if !ok {
+				if extended {
+					out.WriteString(`\{`)
+					continue
+				}
+				return "", fmt.Errorf("invalid interval")
+			}
+			if wasStart {
+				return "", fmt.Errorf("interval has nothing to repeat")
+			}
+			if !wasRepeat {
+				iv := pat[i+1 : i+1+n]
+				if extended {
+					iv = iv[:len(iv)-1]
+				} else {
+					iv = iv[:len(iv)-2]
+				}
+				if strings.HasPrefix(iv, ",") {
+					iv = "0" + iv
+				}
+				out.WriteString("{" + iv + "}")
+			}
+			i += n
+			repeat = true
+		case '}':
+			out.WriteString(`\}`)
+		case '^':
+			if extended || wasStart {
+				out.WriteByte('^')
+				start = true
+			} else {
+				out.WriteString(`\^`)
+			}
+		case '$':
+			if extended || i == len(pat)-1 || strings.HasPrefix(pat[i+1:], `\)`) || strings.HasPrefix(pat[i+1:], `\|`) {
+				out.WriteByte('$')
+			} else {
+				out.WriteString(`\$`)
+			}
+		case '.':
+			out.WriteByte('.')
+		case '[':
+			n, class, err := bracket(pat[i+1:])
+			if err != nil {
+				return "", err
+			}
+			out.WriteString(class)
+			i += n
+		}
+	}
+	if depth > 0 {
+		if extended {
+			return "", fmt.Errorf("unmatched (")
+		}
+		return "", fmt.Errorf("unmatched \\(")
+	}
+	return out.String(), nil
+}
+
+var rxInterval = regexp.MustCompile(`^(?:[0-9]+|[0-9]+,[0-9]*|,[0-9]+)$`)
+
+// interval checks that s starts with the rest of an interval ("n}", "n,}", "n,m}" or ",m}", with \} in a BRE)
+// and returns its length
+func interval(s string, extended bool) (n int, ok bool) {
+	end := `\}`
+	if extended {
+		end = "}"
+	}
+	i := strings.Index(s, end)
+	if i < 0 {
+		return
+	}
+	if !rxInterval.MatchString(s[:i]) {
+		return
+	}
+	return i + len(end), true
+}
+
+// bracket translates the rest of a bracket expression, s starts just after the [.
+// It returns the length of the rest of the expression and its translation.
+// In POSIX a backslash is just a backslash in a bracket expression, and ] is literal if it comes first.
+func bracket(s string) (n int, class string, e error) {
+	var out strings.Builder
+	out.WriteByte('[')
+	i := 0
+	if i < len(s) && s[i] == '^' {
+		out.WriteByte('^')
+		i++
+	}
+	first := true
+	for ; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == ']' && !first:
+			out.WriteByte(']')
+			return i + 1, out.String(), nil
+		case c == '[' && i+1 < len(s) && strings.IndexByte(":=.", s[i+1]) >= 0:
+			// [:class:], [=equivalence=] or [.collating.]
+			kind := s[i+1]
+			end := strings.Index(s[i+2:], string(kind)+"]")
+			if end < 0 {
+				return 0, "", fmt.Errorf("unbalanced [")
+			}
+			name := s[i+2 : i+2+end]
+			if kind == ':' {
+				out.WriteString("[:" + name + ":]")
+			} else if len(name) == 1 {
+				// we only know about single characters, which are only equivalent to themselves
+				out.WriteString(regexp.QuoteMeta(name))
+			} else {
+				return 0, "", fmt.Errorf("invalid collating element: %s", name)
+			}
+			i += 2 + end + 1
+		case c == '\\' || c == '[' || c == ']':
+			out.WriteString(`\` + string(c))
+		default:
+			out.WriteByte(c)
+		}
+		first = false
+	}
+	return 0, "", fmt.Errorf("unbalanced [")
+}
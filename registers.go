@@ -0,0 +1,139 @@
+// registers.go - implements the registers d, c, y and x cut to and paste from
+package ged
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// registerCmds are the commands that can be given a register, as "r before any print suffix (e.g. d"a or y"Ap)
+const registerCmds = "cdxy"
+
+// deleteRing is the number of numbered registers, which keep the last deletions
+const deleteRing = 9
+
+// ErrRegister a register name isn't one we know
+var ErrRegister = fmt.Errorf("invalid register")
+
+// ErrNothingToPut x was asked to paste an empty register
+var ErrNothingToPut = fmt.Errorf("nothing to put")
+
+// registers hold lines that have been cut and copied, for pasting with x.
+// They work like vi's: d, c and y put lines in the unnamed register, which x pastes by default, and in one of
+//   - a named register, a-z, if one is given, or appended to with A-Z
+//   - register 0, the last lines copied by y
+//   - registers 1-9, the last nine deletions by d and c, 1 the most recent
+//
+// Registers belong to the editor rather than a buffer, so lines can be pasted into a different buffer.
+type registers struct {
+	unnamed []string
+	yanked  []string
+	deleted [][]string // most recent first
+	named   map[byte][]string
+}
+
+// parseRegister parses the register at the start of a command's arguments, if there is one.
+// The numbered registers can only be pasted from, so they're invalid for a command that cuts or copies (put set),
+// and we check before the command changes anything.
+func parseRegister(s string, put bool) (reg byte, rest string, e error) {
+	if len(s) == 0 || s[0] != '"' {
+		return 0, s, nil
+	}
+	if len(s) < 2 {
+		return 0, s, ErrRegister
+	}
+	switch c := s[1]; {
+	case c >= '0' && c <= '9' && put:
+	case c == '"', c >= '0' && c <= '9', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		return c, s[2:], nil
+	}
+	return 0, s, ErrRegister
+}
+
+// put stores lines cut (deleted set) or copied into a register, 0 for none
+func (r *registers) put(reg byte, lines []string, deleted bool) (e error) {
+	switch {
+	case reg >= 'a' && reg <= 'z':
+		if r.named == nil {
+			r.named = make(map[byte][]string)
+		}
+		r.named[reg] = lines
+	case reg >= 'A' && reg <= 'Z':
+		reg += 'a' - 'A'
+		if r.named == nil {
+			r.named = make(map[byte][]string)
+		}
+		old := r.named[reg]
+		lines = append(old[:len(old):len(old)], lines...)
+		r.named[reg] = lines
+	case reg == 0 || reg == '"':
+		if !deleted {
+			r.yanked = lines
+		} else {
+			r.deleted = append([][]string{lines}, r.deleted...)
+			if len(r.deleted) > deleteRing {
+				r.deleted = r.deleted[:deleteRing]
+			}
+		}
+	default:
+		// the numbered registers are only filled by deleting
+		return ErrRegister
+	}
+	r.unnamed = lines
+	return
+}
+
+// get gets the lines in a register, 0 for the unnamed register
+func (r *registers) get(reg byte) (lines []string, e error) {
+	switch {
+	case reg == 0 || reg == '"':
+		lines = r.unnamed
+	case reg == '0':
+		lines = r.yanked
+	case reg >= '1' && reg <= '9':
+		if n := int(reg - '1'); n < len(r.deleted) {
+			lines = r.deleted[n]
+		}
+	case reg >= 'a' && reg <= 'z':
+		lines = r.named[reg]
+	case reg >= 'A' && reg <= 'Z':
+		lines = r.named[reg+'a'-'A']
+	default:
+		return nil, ErrRegister
+	}
+	if len(lines) == 0 {
+		return nil, ErrNothingToPut
+	}
+	return
+}
+
+// cmdRegisters lists the registers that have something in them, or just the ones named (e.g. R a1)
+func (ed *Editor) cmdRegisters(ctx *Context) (e error) {
+	arg := ctx.cmd[ctx.cmdOffset+1:]
+	arg = arg[wsOffset(arg):]
+	names := `"0123456789abcdefghijklmnopqrstuvwxyz`
+	if len(arg) > 0 {
+		names = strings.Replace(arg, " ", "", -1)
+	}
+	for i := 0; i < len(names); i++ {
+		reg := names[i]
+		lines, err := ed.regs.get(reg)
+		if err == ErrRegister {
+			return err
+		} else if err != nil {
+			continue
+		}
+		// like l, but one line of output per register, cut to fit the window
+		list := make([]string, len(lines))
+		for i, l := range lines {
+			list[i] = strings.TrimSuffix(listLine(l, 0, 0), "$")
+		}
+		s := strings.Join(list, "^J")
+		if w := ed.winCols - 8; w > 0 && utf8.RuneCountInString(s) > w {
+			s = string([]rune(s)[:w])
+		}
+		fmt.Fprintf(ed.out, "\"%c\t%s\n", reg, s)
+	}
+	return
+}
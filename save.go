@@ -0,0 +1,227 @@
+// save.go - implements safe writing of files for FileBuffer
+package ged
+
+import (
+	"crypto/sha256"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// A fileStamp records what a file looked like when a FileBuffer last read or wrote it
+type fileStamp struct {
+	name string
+	size int64
+	hash [sha256.Size]byte
+}
+
+// newFileStamp creates a fileStamp from a file's info and the hash of its content
+func newFileStamp(name string, fi os.FileInfo, h hash.Hash) (s fileStamp) {
+	s.name = name
+	s.size = fi.Size()
+	copy(s.hash[:], h.Sum(nil))
+	return
+}
+
+// stampFile reads a file to create a fileStamp for it
+func stampFile(file string) (s fileStamp, e error) {
+	var fh *os.File
+	if fh, e = os.Open(file); e != nil {
+		return
+	}
+	defer fh.Close()
+	var fi os.FileInfo
+	if fi, e = fh.Stat(); e != nil {
+		return
+	}
+	h := sha256.New()
+	if _, e = io.Copy(h, fh); e != nil {
+		return
+	}
+	return newFileStamp(file, fi, h), nil
+}
+
+// Changed checks whether a file has changed on disk since the FileBuffer last read or wrote it.
+// A file of a different size has changed, otherwise the content is compared, since a change can keep the size
+// and timestamps may be too coarse to show it.  A file that was only touched hasn't changed.
+// Files the FileBuffer didn't come from, and files that no longer exist, haven't changed.
+func (f *FileBuffer) Changed(file string) (changed bool, e error) {
+	if !f.isDisk(file) {
+		return
+	}
+	var fi os.FileInfo
+	if fi, e = os.Stat(file); os.IsNotExist(e) {
+		return false, nil
+	} else if e != nil {
+		return
+	}
+	if fi.Size() != f.disk.size {
+		return true, nil
+	}
+	var s fileStamp
+	if s, e = stampFile(file); os.IsNotExist(e) {
+		return false, nil
+	} else if e != nil {
+		return
+	}
+	return s.hash != f.disk.hash, nil
+}
+
+// Restamp records what the FileBuffer's file looks like now, e.g. after appending to it.
+// Other files are ignored.
+func (f *FileBuffer) Restamp(file string) (e error) {
+	if !f.isDisk(file) {
+		return
+	}
+	var s fileStamp
+	if s, e = stampFile(file); e == nil {
+		f.disk = s
+	}
+	return
+}
+
+// WriteFile safely writes a line range to a file, replacing it.
+// The lines are written to a temporary file in the same directory which is synced and then renamed
+// over the file, so a crash or a full disk never leaves it half written.  The file keeps its mode
+// and owner, and if it's a symlink the file it points to is replaced.
+// If backup is set, the old file is kept as file~.
+// The FileBuffer remembers what it wrote, see Changed.
+func (f *FileBuffer) WriteFile(r [2]int, file string, backup bool) (n int, e error) {
+	defer func() {
+		if e == nil {
+			f.stamp(r, file)
+		}
+	}()
+	target := file
+	if target, e = filepath.EvalSymlinks(file); os.IsNotExist(e) {
+		// there's nothing to lose (even if it's a dangling symlink), so write it directly
+		return f.writeDirect(r, file)
+	} else if e != nil {
+		return
+	}
+	var fi os.FileInfo
+	if fi, e = os.Stat(target); e != nil {
+		return
+	}
+	var tmp *os.File
+	if tmp, e = ioutil.TempFile(filepath.Dir(target), "."+filepath.Base(target)+".ged"); e != nil {
+		// we can't create files next to it, so we can only write it in place
+		return f.writeInPlace(r, target, backup)
+	}
+	defer func() {
+		if e != nil {
+			os.Remove(tmp.Name())
+		}
+	}()
+	if n, e = f.Write(r, tmp); e == nil {
+		e = tmp.Sync()
+	}
+	if ce := tmp.Close(); e == nil {
+		e = ce
+	}
+	if e != nil {
+		return
+	}
+	if e = os.Chmod(tmp.Name(), fi.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); e != nil {
+		return
+	}
+	if chown(tmp.Name(), fi) != nil {
+		// writing in place is better than giving the file away to us
+		os.Remove(tmp.Name())
+		return f.writeInPlace(r, target, backup)
+	}
+	if backup {
+		if e = backupFile(target, fi); e != nil {
+			return
+		}
+	}
+	if e = os.Rename(tmp.Name(), target); e != nil {
+		return
+	}
+	syncDir(filepath.Dir(target))
+	return
+}
+
+// isDisk checks whether a file is the one the FileBuffer last read or wrote
+func (f *FileBuffer) isDisk(file string) bool {
+	return f.disk.name != "" && filepath.Clean(file) == filepath.Clean(f.disk.name)
+}
+
+// stamp records that a line range was just written to a file, without reading it back
+func (f *FileBuffer) stamp(r [2]int, file string) {
+	fi, e := os.Stat(file)
+	if e != nil {
+		return
+	}
+	h := sha256.New()
+	if _, e = f.Write(r, h); e == nil {
+		f.disk = newFileStamp(file, fi, h)
+	}
+}
+
+// writeInPlace overwrites an existing file when it can't be replaced
+func (f *FileBuffer) writeInPlace(r [2]int, file string, backup bool) (n int, e error) {
+	if backup {
+		var fi os.FileInfo
+		if fi, e = os.Stat(file); e != nil {
+			return
+		}
+		if e = backupFile(file, fi); e != nil {
+			return
+		}
+	}
+	return f.writeDirect(r, file)
+}
+
+// writeDirect writes a line range straight into a file
+func (f *FileBuffer) writeDirect(r [2]int, file string) (n int, e error) {
+	var fh *os.File
+	if fh, e = os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666); e != nil {
+		return
+	}
+	if n, e = f.Write(r, fh); e == nil {
+		e = fh.Sync()
+	}
+	if ce := fh.Close(); e == nil {
+		e = ce
+	}
+	return
+}
+
+// backupFile keeps a copy of a file as file~, replacing any old backup
+func backupFile(file string, fi os.FileInfo) (e error) {
+	bak := file + "~"
+	if e = os.Remove(bak); e != nil && !os.IsNotExist(e) {
+		return
+	}
+	if os.Link(file, bak) == nil {
+		return nil
+	}
+	// not every filesystem has hard links, so fall back to copying
+	var in, out *os.File
+	if in, e = os.Open(file); e != nil {
+		return
+	}
+	defer in.Close()
+	if out, e = os.OpenFile(bak, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode().Perm()); e != nil {
+		return
+	}
+	if _, e = io.Copy(out, in); e == nil {
+		e = out.Sync()
+	}
+	if ce := out.Close(); e == nil {
+		e = ce
+	}
+	return
+}
+
+// syncDir makes sure a rename in a directory is on disk
+// Not every platform can sync a directory, so errors are ignored.
+func syncDir(dir string) {
+	if d, e := os.Open(dir); e == nil {
+		d.Sync()
+		d.Close()
+	}
+}
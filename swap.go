@@ -0,0 +1,166 @@
+// swap.go - implements the swap journal and checkpoints, so a FileBuffer can be recovered after a crash
+package ged
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"path/filepath"
+	"time"
+)
+
+// A journalEntry records the state after a transaction.
+// Lines are never removed from the buffer, so we only need the lines that are new since the last entry.
+type journalEntry struct {
+	Lines  []string // lines added to the buffer
+	Pieces [][2]int // the file, as runs of buffer lines (see piece)
+	Addr   int
+	CRLF   bool
+	NoEOL  bool
+}
+
+// A journal writes journalEntries to a swap file
+type journal struct {
+	w      io.Writer
+	enc    *gob.Encoder
+	lines  int       // buffer lines already in the journal
+	synced time.Time // last time the journal was synced to disk
+	err    error     // the error that stopped the journal
+}
+
+// journalSync is how often the journal is synced to disk, if it can be
+const journalSync = 5 * time.Second
+
+// SwapFile is the name of the swap journal kept for a file
+func SwapFile(file string) string {
+	return filepath.Join(filepath.Dir(file), "."+filepath.Base(file)+".ged-swap")
+}
+
+// Journal starts recording every transaction to w, beginning with the current state.
+// A nil w stops the journal.
+func (f *FileBuffer) Journal(w io.Writer) (e error) {
+	if w == nil {
+		f.journal = nil
+		return
+	}
+	f.journal = &journal{
+		w:      w,
+		enc:    gob.NewEncoder(w),
+		synced: time.Now(),
+	}
+	f.record()
+	return f.JournalErr()
+}
+
+// JournalErr returns the error that stopped the journal, if it has stopped
+func (f *FileBuffer) JournalErr() (e error) {
+	if f.journal == nil || f.journal.err == nil {
+		return
+	}
+	e = f.journal.err
+	f.journal = nil
+	return
+}
+
+// record adds the current state to the journal
+func (f *FileBuffer) record() {
+	j := f.journal
+	if j == nil || j.err != nil {
+		return
+	}
+	en := journalEntry{
+		Lines: f.buffer[j.lines:],
+		Addr:  f.addr,
+		CRLF:  f.crlf,
+		NoEOL: f.noEOL,
+	}
+	for _, p := range f.file.Pieces() {
+		en.Pieces = append(en.Pieces, [2]int{p.start, p.count})
+	}
+	if j.err = j.enc.Encode(&en); j.err != nil {
+		return
+	}
+	j.lines = len(f.buffer)
+	if s, ok := j.w.(interface{ Sync() error }); ok && time.Since(j.synced) > journalSync {
+		j.err = s.Sync()
+		j.synced = time.Now()
+	}
+}
+
+// JournalToBuffer replays a swap journal and creates a new FileBuffer from it.
+// A crash can leave the last entry half written, so it is ignored.
+// The new FileBuffer has nothing in common with any file, so it starts out dirty.
+func JournalToBuffer(r io.Reader) (fb *FileBuffer, e error) {
+	fb = NewFileBuffer(nil)
+	dec := gob.NewDecoder(r)
+	n := 0
+	for {
+		var en journalEntry
+		if e = dec.Decode(&en); e == io.EOF || e == io.ErrUnexpectedEOF {
+			break
+		} else if e != nil {
+			return nil, fmt.Errorf("could not read swap journal: %v", e)
+		}
+		fb.buffer = append(fb.buffer, en.Lines...)
+		pieces := make([]piece, 0, len(en.Pieces))
+		for _, p := range en.Pieces {
+			if p[0] < 0 || p[1] < 0 || p[0]+p[1] > len(fb.buffer) {
+				return nil, fmt.Errorf("could not read swap journal: corrupt entry %d", n)
+			}
+			pieces = append(pieces, piece{p[0], p[1]})
+		}
+		fb.file = newLineMap(pieces)
+		fb.addr = en.Addr
+		fb.crlf = en.CRLF
+		fb.noEOL = en.NoEOL
+		n++
+	}
+	if n == 0 {
+		return nil, fmt.Errorf("could not read swap journal: it's empty")
+	}
+	if fb.OOB(fb.addr) {
+		fb.addr = fb.Len() - 1
+	}
+	fb.Touch()
+	fb.mod = false
+	return fb, nil
+}
+
+// A checkpoint is what a FileBuffer contained at the end of its last transaction.
+// Lines in the buffer and the pieces of a snapshot never change, so they can be shared, but the flags are copied,
+// since a snapshot's dirty flag does change (see Clean).  A checkpoint stays valid while the FileBuffer goes on
+// changing, even in another goroutine.
+type checkpoint struct {
+	buffer []string
+	file   []piece
+	dirty  bool
+	crlf   bool
+	noEOL  bool
+}
+
+// checkpoint takes a checkpoint, or returns nil if there are no unsaved changes
+func (f *FileBuffer) checkpoint() *checkpoint {
+	if !f.dirty {
+		return nil
+	}
+	c := &checkpoint{
+		buffer: f.buffer,
+		dirty:  f.dirty,
+		crlf:   f.crlf,
+		noEOL:  f.noEOL,
+	}
+	if f.undo != nil {
+		c.file = f.undo.state.file
+	} else {
+		c.file = f.file.Pieces()
+	}
+	return c
+}
+
+// FileBuffer creates a FileBuffer from a checkpoint
+func (c *checkpoint) FileBuffer() *FileBuffer {
+	fb := NewFileBuffer(c.buffer[:len(c.buffer):len(c.buffer)])
+	fb.file = newLineMap(c.file)
+	fb.dirty, fb.crlf, fb.noEOL = c.dirty, c.crlf, c.noEOL
+	return fb
+}
@@ -1,44 +1,208 @@
 // system.go implements the "System" wrapper class to exec.Cmd
 
-package main
+package ged
 
 import (
+	"fmt"
 	"io"
+	"os"
 	"os/exec"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
-	shellpath = "/bin/sh"
+	shellpath = "/bin/sh" // the shell, if $SHELL isn't set
 	shellopts = "-c"
+	killWait  = time.Second // how long to wait for a killed command to finish
 )
 
-// System is a wrapper around exec.Cmd to run things in the Ed way
+// ErrNoCommand ! was used to repeat the previous shell command before there was one
+var ErrNoCommand = fmt.Errorf("no previous command")
+
+// ErrTimeout a shell command ran for longer than its Timeout, and was killed
+var ErrTimeout = fmt.Errorf("command timed out")
+
+// ErrOutputLimit a shell command wrote more than its MaxOutput, and was killed
+var ErrOutputLimit = fmt.Errorf("command output too large")
+
+// System is a wrapper around exec.Cmd to run things in the Ed way.
+// Cmd is given to the shell as it is, see ExpandCommand for the substitutions ed makes first.
+// Stdin is streamed to the command, and its output is streamed to Stdout and Stderr as it's written.
 type System struct {
 	Cmd    string
+	Shell  string // the shell to run Cmd with, if empty $SHELL, or /bin/sh if that isn't set
 	Stdin  io.Reader
 	Stdout io.Writer
 	Stderr io.Writer
+	Env    []string // added to our environment for the command, as "key=value"
+	// Interrupt kills the command when it's closed, and Run returns ErrInterrupt
+	Interrupt <-chan struct{}
+	// Timeout kills the command if it runs for longer, and Run returns ErrTimeout.  0 is no limit.
+	Timeout time.Duration
+	// MaxOutput kills the command if it writes more than this many bytes to Stdout, and Run returns ErrOutputLimit.
+	// 0 is no limit.  Stderr counts too if it's the same as Stdout.  Limiting a file isn't as fast, since we copy to it.
+	MaxOutput int64
+}
 
-	cmdSane string
-	exe     *exec.Cmd
+// ExpandCommand makes ed's substitutions in a shell command: a leading ! is replaced by the previous command, last,
+// and an unescaped % by the current filename.  \% is a literal %, other backslashes are left for the shell.
+// changed says whether anything was substituted, ed prints the command before running it if it was.
+func ExpandCommand(cmd, file, last string) (expanded string, changed bool, e error) {
+	var out strings.Builder
+	i := 0
+	if strings.HasPrefix(cmd, "!") {
+		if len(last) == 0 {
+			return "", false, ErrNoCommand
+		}
+		out.WriteString(last)
+		changed = true
+		i++
+	}
+	for ; i < len(cmd); i++ {
+		switch c := cmd[i]; {
+		case c == '\\' && i+1 < len(cmd):
+			// an escaped backslash can't escape a %, so we skip over whatever is escaped
+			if cmd[i+1] != '%' {
+				out.WriteByte(c)
+			}
+			out.WriteByte(cmd[i+1])
+			i++
+		case c == '%':
+			if len(file) == 0 {
+				return "", false, fmt.Errorf("no current filename")
+			}
+			out.WriteString(file)
+			changed = true
+		default:
+			out.WriteByte(c)
+		}
+	}
+	return out.String(), changed, nil
 }
 
 // Run a command (using the shell for arg processing)
 func (s *System) Run() (e error) {
-	s.cmdSane = rxSanitize.ReplaceAllString(s.Cmd, "..")
-	idx := rxCmdSub.FindAllStringIndex(s.cmdSane, -1)
-	fCmd := ""
-	oCmd := 0
-	for _, m := range idx {
-		fCmd += s.Cmd[oCmd:m[0]]
-		fCmd += state.fileName
-		oCmd = m[1]
-	}
-	fCmd += s.Cmd[oCmd:]
-
-	cmd := exec.Command(shellpath, shellopts, fCmd)
+	shell := s.Shell
+	if len(shell) == 0 {
+		shell = os.Getenv("SHELL")
+	}
+	if len(shell) == 0 {
+		shell = shellpath
+	}
+	cmd := exec.Command(shell, shellopts, s.Cmd)
+	if len(s.Env) > 0 {
+		cmd.Env = append(os.Environ(), s.Env...)
+	}
 	cmd.Stdin = s.Stdin
-	cmd.Stdout = s.Stdout
-	cmd.Stderr = s.Stderr
-	return cmd.Run()
+	stdout := s.Stdout
+	var over chan struct{} // closed when the output limit is reached
+	if s.MaxOutput > 0 && stdout != nil {
+		over = make(chan struct{})
+		stdout = &limitWriter{w: stdout, n: s.MaxOutput, over: over}
+	}
+	// a command we give up waiting for mustn't write anything after we return
+	var closeOut func()
+	cmd.Stdout, closeOut = gateWriter(stdout)
+	defer closeOut()
+	if sameWriter(s.Stdout, s.Stderr) {
+		cmd.Stderr = cmd.Stdout
+	} else {
+		var closeErr func()
+		cmd.Stderr, closeErr = gateWriter(s.Stderr)
+		defer closeErr()
+	}
+	if e = cmd.Start(); e != nil {
+		return
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	var timeout <-chan time.Time
+	if s.Timeout > 0 {
+		t := time.NewTimer(s.Timeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case e = <-done:
+		select {
+		case <-over:
+			// it may have finished before we noticed it was over the limit
+			e = ErrOutputLimit
+		default:
+		}
+		return
+	case <-s.Interrupt:
+		e = ErrInterrupt
+	case <-timeout:
+		e = ErrTimeout
+	case <-over:
+		e = ErrOutputLimit
+	}
+	cmd.Process.Kill()
+	// anything the shell started can keep its output open, so we can't always wait for it
+	select {
+	case <-done:
+	case <-time.After(killWait):
+	}
+	return
+}
+
+// A limitWriter writes up to n bytes, and then closes over and fails
+type limitWriter struct {
+	w    io.Writer
+	n    int64
+	over chan struct{}
+}
+
+func (l *limitWriter) Write(p []byte) (n int, e error) {
+	if int64(len(p)) > l.n {
+		if l.n >= 0 {
+			close(l.over)
+			l.n = -1
+		}
+		return 0, ErrOutputLimit
+	}
+	l.n -= int64(len(p))
+	return l.w.Write(p)
+}
+
+// A gate passes writes on to a writer until it's closed, and then quietly drops them
+type gate struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closed bool
+}
+
+// gateWriter puts a gate in front of w, and returns a function to close it.
+// Files are written by the command itself rather than by us, so they don't need one.
+func gateWriter(w io.Writer) (io.Writer, func()) {
+	if _, ok := w.(*os.File); ok || w == nil {
+		return w, func() {}
+	}
+	g := &gate{w: w}
+	return g, g.close
+}
+
+func (g *gate) Write(p []byte) (n int, e error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return len(p), nil
+	}
+	return g.w.Write(p)
+}
+
+func (g *gate) close() {
+	g.mu.Lock()
+	g.closed = true
+	g.mu.Unlock()
+}
+
+// sameWriter says whether two writers are the same, so a command's output and errors can share one gate
+func sameWriter(a, b io.Writer) (same bool) {
+	// writers that can't be compared aren't the same
+	defer func() { recover() }()
+	return a == b
 }
@@ -0,0 +1,9 @@
+// term_linux.go - termios ioctls for linux
+package ged
+
+import "syscall"
+
+const (
+	ioctlGetTermios = syscall.TCGETS
+	ioctlSetTermios = syscall.TCSETS
+)
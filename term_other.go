@@ -0,0 +1,35 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd,!dragonfly
+
+// term_other.go - terminal handling for systems without termios
+package ged
+
+import "fmt"
+
+var errNoTermios = fmt.Errorf("terminals are not supported")
+
+// termSize gets the size of a terminal
+func termSize(fd uintptr) (lines, cols int, e error) {
+	return 0, 0, errNoTermios
+}
+
+// A termState is the state of a terminal before we changed it
+type termState struct{}
+
+// isTerminal checks if a file descriptor is a terminal
+func isTerminal(fd uintptr) bool {
+	return false
+}
+
+// makeRaw puts a terminal in raw mode
+func makeRaw(fd uintptr) (old *termState, e error) {
+	return nil, errNoTermios
+}
+
+// restoreTerm puts a terminal back the way it was
+func restoreTerm(fd uintptr, old *termState) error {
+	return errNoTermios
+}
+
+// suspend stops ged
+func suspend() {}
@@ -0,0 +1,72 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+// +build linux darwin freebsd netbsd openbsd dragonfly
+
+// term_unix.go - terminal handling for systems with termios
+package ged
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// winsize is struct winsize from ioctl_tty(2)
+type winsize struct {
+	row    uint16
+	col    uint16
+	xpixel uint16
+	ypixel uint16
+}
+
+// termSize gets the size of a terminal
+func termSize(fd uintptr) (lines, cols int, e error) {
+	var ws winsize
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, uintptr(syscall.TIOCGWINSZ), uintptr(unsafe.Pointer(&ws))); errno != 0 {
+		return 0, 0, errno
+	}
+	return int(ws.row), int(ws.col), nil
+}
+
+// A termState is the state of a terminal before we changed it
+type termState struct {
+	termios syscall.Termios
+}
+
+// termios gets or sets the termios of a terminal
+func termios(fd uintptr, req uintptr, t *syscall.Termios) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(unsafe.Pointer(t))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// isTerminal checks if a file descriptor is a terminal
+func isTerminal(fd uintptr) bool {
+	var t syscall.Termios
+	return termios(fd, ioctlGetTermios, &t) == nil
+}
+
+// makeRaw puts a terminal in raw mode, so we get every key as it's pressed, and nothing is echoed.
+// Output processing is left alone, so \n still starts a new line.
+func makeRaw(fd uintptr) (old *termState, e error) {
+	var t syscall.Termios
+	if e = termios(fd, ioctlGetTermios, &t); e != nil {
+		return
+	}
+	old = &termState{t}
+	t.Iflag &^= syscall.ICRNL | syscall.INLCR | syscall.IGNCR | syscall.ISTRIP | syscall.IXON
+	t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	t.Cc[syscall.VMIN] = 1
+	t.Cc[syscall.VTIME] = 0
+	e = termios(fd, ioctlSetTermios, &t)
+	return
+}
+
+// restoreTerm puts a terminal back the way it was
+func restoreTerm(fd uintptr, old *termState) error {
+	return termios(fd, ioctlSetTermios, &old.termios)
+}
+
+// suspend stops ged, as ^Z would if the terminal weren't in raw mode
+func suspend() {
+	syscall.Kill(syscall.Getpid(), syscall.SIGTSTP)
+}
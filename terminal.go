@@ -0,0 +1,155 @@
+// terminal.go - defines the Terminal, for reading commands with line editing and history
+package ged
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ErrNotTerminal the line editor was asked to read from something that isn't a terminal
+var ErrNotTerminal = fmt.Errorf("not a terminal")
+
+// historyMax is the number of commands kept in the history file
+const historyMax = 1000
+
+// A Terminal reads lines from a terminal, letting them be edited as they're typed.
+// The terminal is only in raw mode while a line is being read, so commands run with it as they found it.
+// Commands are kept in a history, which is saved to a file when the Terminal is closed.
+// See Editor.SetTerminal.
+type Terminal struct {
+	in       *os.File
+	editor   *lineEditor
+	histFile string
+	prompt   string // the prompt for the next line
+	command  bool   // is the next line a command?
+	line     string
+	err      error
+
+	mu    sync.Mutex // guards state, so Restore can be called from another goroutine
+	state *termState // how the terminal was before we put it in raw mode, nil if it isn't
+}
+
+// NewTerminal creates a Terminal reading from in and echoing to out, which must both be terminals.
+// The history is read from historyFile if it exists, and saved to it by Close.  An empty historyFile keeps no history.
+func NewTerminal(in, out *os.File, historyFile string) (t *Terminal, e error) {
+	if !isTerminal(in.Fd()) || !isTerminal(out.Fd()) {
+		return nil, ErrNotTerminal
+	}
+	t = &Terminal{
+		in:       in,
+		histFile: historyFile,
+	}
+	t.editor = &lineEditor{
+		r:   bufio.NewReader(in),
+		out: out,
+		cols: func() int {
+			if _, cols, e := termSize(out.Fd()); e == nil && cols > 0 {
+				return cols
+			}
+			return 80
+		},
+		suspend: t.suspend,
+	}
+	if len(historyFile) > 0 {
+		// no history yet isn't an error
+		if b, e := ioutil.ReadFile(historyFile); e == nil {
+			t.editor.history = strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+		}
+	}
+	return
+}
+
+// Command makes the next line read a command, shown after prompt, with history and filename completion
+func (t *Terminal) Command(prompt string) {
+	t.prompt = prompt
+	t.command = true
+}
+
+// Scan reads the next line, it returns false at the end of the input or on an error.
+// ^D on an empty line ends the input, but only for this Scan; the next one carries on reading.
+func (t *Terminal) Scan() bool {
+	if t.err != nil {
+		return false
+	}
+	prompt, cmd := t.prompt, t.command
+	t.prompt, t.command = "", false
+	if t.err = t.raw(); t.err != nil {
+		return false
+	}
+	t.line, t.err = t.editor.readLine(prompt, cmd)
+	if e := t.restore(); e != nil && t.err == nil {
+		t.err = e
+	}
+	if t.err == io.EOF {
+		t.err = nil
+		return false
+	}
+	return t.err == nil
+}
+
+// Text returns the last line read
+func (t *Terminal) Text() string {
+	return t.line
+}
+
+// Err returns the error that stopped the Terminal reading
+func (t *Terminal) Err() error {
+	return t.err
+}
+
+// Restore puts the terminal back the way we found it, if it's in raw mode.
+// It's safe to call from another goroutine, e.g. before exiting on a signal.
+func (t *Terminal) Restore() {
+	t.restore()
+}
+
+// Close restores the terminal and saves the history
+func (t *Terminal) Close() (e error) {
+	t.restore()
+	if len(t.histFile) == 0 || len(t.editor.history) == 0 {
+		return
+	}
+	h := t.editor.history
+	if len(h) > historyMax {
+		h = h[len(h)-historyMax:]
+	}
+	if e = ioutil.WriteFile(t.histFile, []byte(strings.Join(h, "\n")+"\n"), 0600); e != nil {
+		return fmt.Errorf("could not save history: %v", e)
+	}
+	return
+}
+
+// raw puts the terminal in raw mode
+func (t *Terminal) raw() (e error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.state != nil {
+		return
+	}
+	t.state, e = makeRaw(t.in.Fd())
+	return
+}
+
+// restore takes the terminal out of raw mode
+func (t *Terminal) restore() (e error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.state == nil {
+		return
+	}
+	e = restoreTerm(t.in.Fd(), t.state)
+	t.state = nil
+	return
+}
+
+// suspend stops ged for ^Z, with the terminal restored until we're continued
+func (t *Terminal) suspend() {
+	t.restore()
+	suspend()
+	t.raw()
+}
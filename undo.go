@@ -0,0 +1,260 @@
+// undo.go - implements transactions and the undo tree for FileBuffer
+package ged
+
+import (
+	"fmt"
+	"time"
+)
+
+// A snapshot records the state of a FileBuffer for undo/redo.
+// Since the buffer never loses lines, we only need to remember how they're mapped.
+type snapshot struct {
+	file  []piece
+	addr  int
+	dirty bool
+	crlf  bool
+	noEOL bool
+	marks map[byte]int
+}
+
+// An undoNode is a state in the undo tree.
+// Every transaction that modifies the file adds a new node as a child of the current one,
+// so undoing and then making a change starts a new branch rather than losing the old one.
+type undoNode struct {
+	seq      int
+	time     time.Time
+	state    snapshot
+	parent   *undoNode
+	children []*undoNode
+	next     *undoNode // the child we redo into
+}
+
+// An UndoInfo describes a state in the undo tree
+type UndoInfo struct {
+	Seq     int       // number of the state
+	Parent  int       // number of the parent state, -1 for the root
+	Time    time.Time // when the state was created
+	Lines   int       // number of lines in the file
+	Current bool      // is this the current state?
+}
+
+// ErrNoUndo there is nothing to undo
+var ErrNoUndo = fmt.Errorf("nothing to undo")
+
+// ErrNoRedo there is nothing to redo
+var ErrNoRedo = fmt.Errorf("nothing to redo")
+
+// Start a transaction
+func (f *FileBuffer) Start() {
+	f.mod = false
+	f.jumped = false
+	f.tmp = f.snapshot()
+	f.tmpUndo = f.undo
+}
+
+// End a transaction
+// If anything was modified, the new state is added to the undo tree below the current one.
+// Any change, including undo, is recorded in the journal.
+func (f *FileBuffer) End() {
+	if f.mod || f.jumped {
+		defer f.record()
+	}
+	if !f.mod {
+		return
+	}
+	if f.undo == nil {
+		// the first change, so we need a root for the state we started with
+		f.undo = f.newNode(nil, f.tmp)
+	}
+	f.undo = f.newNode(f.undo, f.snapshot())
+	f.prune()
+}
+
+// Cancel ends a transaction by throwing away its changes, as though it never happened
+func (f *FileBuffer) Cancel() {
+	if f.mod || f.jumped {
+		f.restore(f.tmp)
+		f.undo = f.tmpUndo
+		f.jumped = false
+	}
+}
+
+// Rewind restores the parent of the current state in the undo tree
+func (f *FileBuffer) Rewind() (e error) {
+	if f.undo == nil || f.undo.parent == nil {
+		return ErrNoUndo
+	}
+	f.undo.parent.next = f.undo
+	f.undo = f.undo.parent
+	f.restore(f.undo.state)
+	return
+}
+
+// Forward restores the most recently used child of the current state in the undo tree
+func (f *FileBuffer) Forward() (e error) {
+	if f.undo == nil || f.undo.next == nil {
+		return ErrNoRedo
+	}
+	f.undo = f.undo.next
+	f.restore(f.undo.state)
+	return
+}
+
+// UndoTree describes every state in the undo tree, oldest first
+func (f *FileBuffer) UndoTree() (states []UndoInfo) {
+	for _, n := range f.tree {
+		i := UndoInfo{
+			Seq:     n.seq,
+			Parent:  -1,
+			Time:    n.time,
+			Lines:   n.state.lines(),
+			Current: n == f.undo,
+		}
+		if n.parent != nil {
+			i.Parent = n.parent.seq
+		}
+		states = append(states, i)
+	}
+	return
+}
+
+// UndoTo restores a state in the undo tree by number
+func (f *FileBuffer) UndoTo(seq int) (e error) {
+	for _, n := range f.tree {
+		if n.seq == seq {
+			f.jump(n)
+			return
+		}
+	}
+	return fmt.Errorf("no such undo state: %d", seq)
+}
+
+// UndoAt restores the state the file was in at time t
+func (f *FileBuffer) UndoAt(t time.Time) (e error) {
+	if len(f.tree) == 0 {
+		return ErrNoUndo
+	}
+	n := f.tree[0] // if we don't have anything that old, the root is as close as we get
+	for _, c := range f.tree {
+		if c.time.After(t) {
+			break
+		}
+		n = c
+	}
+	f.jump(n)
+	return
+}
+
+// SetHistory sets the maximum depth of the undo history, 0 is unlimited
+func (f *FileBuffer) SetHistory(depth int) {
+	f.history = depth
+	f.prune()
+}
+
+// newNode adds a state to the undo tree
+func (f *FileBuffer) newNode(parent *undoNode, s snapshot) (n *undoNode) {
+	n = &undoNode{
+		seq:    f.seq,
+		time:   time.Now(),
+		state:  s,
+		parent: parent,
+	}
+	f.seq++
+	if parent != nil {
+		parent.children = append(parent.children, n)
+		parent.next = n
+	}
+	f.tree = append(f.tree, n)
+	return
+}
+
+// jump restores any state in the undo tree, redo will follow the path we took to get there
+func (f *FileBuffer) jump(n *undoNode) {
+	for c := n; c.parent != nil; c = c.parent {
+		c.parent.next = c
+	}
+	f.undo = n
+	f.restore(n.state)
+}
+
+// prune removes states until the tree is within the history depth, which counts undo steps back from the current state.
+// States we can't undo to go first, the oldest leaf of a redo or other branch first, and only then the oldest ancestors.
+// The current state is never removed.
+func (f *FileBuffer) prune() {
+	for f.history > 0 && len(f.tree) > f.history+1 {
+		var rm *undoNode
+		for _, n := range f.tree {
+			if len(n.children) == 0 && n != f.undo {
+				rm = n
+				break
+			}
+		}
+		if rm != nil {
+			p := rm.parent
+			for i, c := range p.children {
+				if c == rm {
+					p.children = append(p.children[:i], p.children[i+1:]...)
+					break
+				}
+			}
+			if p.next == rm {
+				p.next = nil
+				if len(p.children) > 0 {
+					p.next = p.children[len(p.children)-1]
+				}
+			}
+		} else {
+			// all that's left is the path from the root to the current state, so the root goes
+			rm = f.tree[0]
+			if rm == f.undo || len(rm.children) != 1 {
+				return
+			}
+			rm.children[0].parent = nil
+		}
+		for i, n := range f.tree {
+			if n == rm {
+				f.tree = append(f.tree[:i], f.tree[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// snapshot records the current state
+func (f *FileBuffer) snapshot() (s snapshot) {
+	s.file = f.file.Pieces()
+	s.addr = f.addr
+	s.dirty = f.dirty
+	s.crlf = f.crlf
+	s.noEOL = f.noEOL
+	s.marks = make(map[byte]int, len(f.marks))
+	for c, l := range f.marks {
+		s.marks[c] = l
+	}
+	return
+}
+
+// restore returns to a recorded state
+// The snapshot stays in the undo tree, so we restore a copy of it.
+// This doesn't count as a modification, so it won't be recorded by End.
+func (f *FileBuffer) restore(s snapshot) {
+	f.file = newLineMap(s.file)
+	f.addr = s.addr
+	f.dirty = s.dirty
+	f.crlf = s.crlf
+	f.noEOL = s.noEOL
+	f.marks = make(map[byte]int, len(s.marks))
+	for c, l := range s.marks {
+		f.marks[c] = l
+	}
+	f.mod = false
+	f.jumped = true
+}
+
+// lines counts the lines in the file of a snapshot
+func (s snapshot) lines() (n int) {
+	for _, p := range s.file {
+		n += p.count
+	}
+	return
+}
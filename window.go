@@ -0,0 +1,48 @@
+// window.go - finds the size of the terminal, for z and l
+package ged
+
+import (
+	"os"
+	"strconv"
+)
+
+// WindowSize finds the number of lines and columns of the terminal f is attached to.
+// If f isn't a terminal, or its size is unknown, $LINES and $COLUMNS are used instead.
+// ok is false if the size is still unknown, otherwise a size of 0 means that one is unknown.
+func WindowSize(f *os.File) (lines, cols int, ok bool) {
+	if lines, cols, e := termSize(f.Fd()); e == nil && lines > 0 && cols > 0 {
+		return lines, cols, true
+	}
+	lines, _ = strconv.Atoi(os.Getenv("LINES"))
+	cols, _ = strconv.Atoi(os.Getenv("COLUMNS"))
+	return lines, cols, lines > 0 || cols > 0
+}
+
+// SetWindowSize tells the editor the size of the terminal.
+// Like GNU ed, z scrolls by 2 lines less than the height, and l folds lines 8 columns short of the width.
+// Sizes that are too small (or 0) are ignored.
+// SetWindowSize can be called while another goroutine is running commands, e.g. on SIGWINCH,
+// and the new size is used from the next command.
+func (ed *Editor) SetWindowSize(lines, cols int) {
+	ed.mu.Lock()
+	if lines > 2 {
+		ed.resize[0] = lines - 2
+	}
+	if cols > 8 {
+		ed.resize[1] = cols - 8
+	}
+	ed.mu.Unlock()
+}
+
+// resized starts using the size from SetWindowSize
+func (ed *Editor) resized() {
+	ed.mu.Lock()
+	if ed.resize[0] > 0 {
+		ed.winSize = ed.resize[0]
+	}
+	if ed.resize[1] > 0 {
+		ed.winCols = ed.resize[1]
+	}
+	ed.resize = [2]int{}
+	ed.mu.Unlock()
+}